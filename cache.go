@@ -0,0 +1,152 @@
+package renderfs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/nikolalohinski/gonja/v2/exec"
+)
+
+// DefaultTemplateCacheSize is the number of compiled templates kept by a
+// TemplateCache created with a non-positive size.
+const DefaultTemplateCacheSize = 1024
+
+// defaultTemplateCache backs the package-level render helpers and Copy calls
+// that do not provide their own cache.
+var defaultTemplateCache = NewTemplateCache(DefaultTemplateCacheSize)
+
+// TemplateCache is a bounded, least-recently-used cache of compiled templates.
+// It is safe for concurrent use. Rendered paths and file contents are both
+// cached; templates using extends are not, since their parent is read while
+// compiling.
+type TemplateCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[templateKey]*list.Element
+	order      *list.List // front is most recently used
+	hits       uint64
+	misses     uint64
+
+	// environments holds the environments derived from those of callers,
+	// such as one providing the file tag, so that templates compiled
+	// against them can be reused.
+	environments map[environmentKey]*exec.Environment
+}
+
+// environmentKey identifies the environment derived from base by adding
+// extension.
+type environmentKey struct {
+	base      *exec.Environment
+	extension string
+}
+
+// CacheStats reports the usage of a TemplateCache.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// templateKey identifies a compiled template. The environment is compared by
+// pointer identity; cached templates keep their environment reachable, so an
+// address cannot be reused by another environment while an entry exists.
+type templateKey struct {
+	env        *exec.Environment
+	strict     bool
+	delimiters Delimiters
+	trim       bool
+	lstrip     bool
+	autoEscape bool
+	sum        [sha256.Size]byte
+}
+
+type templateEntry struct {
+	key      templateKey
+	template *exec.Template
+}
+
+// NewTemplateCache creates a cache holding at most maxEntries compiled
+// templates. A non-positive maxEntries uses DefaultTemplateCacheSize.
+func NewTemplateCache(maxEntries int) *TemplateCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultTemplateCacheSize
+	}
+	return &TemplateCache{
+		maxEntries:   maxEntries,
+		entries:      make(map[templateKey]*list.Element),
+		order:        list.New(),
+		environments: make(map[environmentKey]*exec.Environment),
+	}
+}
+
+// Stats returns the hit and miss counters and the current number of entries.
+func (c *TemplateCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{Hits: c.hits, Misses: c.misses, Entries: len(c.entries)}
+}
+
+// Reset drops every cached template and zeroes the counters.
+func (c *TemplateCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.entries)
+	clear(c.environments)
+	c.order.Init()
+	c.hits = 0
+	c.misses = 0
+}
+
+// environment returns the environment build derives from base for
+// extension, building it on first use. At most maxEntries environments are
+// kept; beyond that they are all dropped and built again as needed.
+func (c *TemplateCache) environment(base *exec.Environment, extension string, build func() *exec.Environment) *exec.Environment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := environmentKey{base: base, extension: extension}
+	if env, ok := c.environments[key]; ok {
+		return env
+	}
+	if len(c.environments) >= c.maxEntries {
+		clear(c.environments)
+	}
+	env := build()
+	c.environments[key] = env
+	return env
+}
+
+func (c *TemplateCache) get(key templateKey) (*exec.Template, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*templateEntry).template, true
+}
+
+func (c *TemplateCache) put(key templateKey, tpl *exec.Template) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*templateEntry).template = tpl
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&templateEntry{key: key, template: tpl})
+	for len(c.entries) > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*templateEntry).key)
+	}
+}
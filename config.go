@@ -0,0 +1,66 @@
+package renderfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	ignore "github.com/sabhiram/go-gitignore"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileName is the name of the optional configuration file at the root
+// of the source filesystem. It is never copied.
+const configFileName = ".renderfs.yaml"
+
+// sourceConfig is the content of the configuration file, for example
+//
+//	copy_without_render:
+//	  - "assets/*.min.js"
+//	  - "*.tpl"
+type sourceConfig struct {
+	// CopyWithoutRender extends Options.CopyWithoutRender.
+	CopyWithoutRender []string `yaml:"copy_without_render"`
+}
+
+// loadSourceConfig reads the configuration file of source. A missing file
+// yields an empty configuration; unknown keys are rejected.
+func loadSourceConfig(source fs.FS) (*sourceConfig, error) {
+	raw, err := fs.ReadFile(source, configFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &sourceConfig{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("renderfs: read %s: %w", configFileName, err)
+	}
+
+	cfg := &sourceConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("renderfs: parse %s: %w", configFileName, err)
+	}
+	return cfg, nil
+}
+
+// compilePatterns compiles gitignore-style patterns, skipping blank ones. It
+// returns nil when there are none.
+func compilePatterns(patterns ...[]string) *ignore.GitIgnore {
+	var lines []string
+	for _, list := range patterns {
+		for _, pattern := range list {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			lines = append(lines, pattern)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return ignore.CompileIgnoreLines(lines...)
+}
@@ -2,202 +2,159 @@ package renderfs
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
-	"path"
 	"strings"
 )
 
 // Copy walks the source filesystem, renders templates, and writes to dest.
 // It returns statistics on files created, updated, skipped, or found identical.
+// Every path and template is rendered by Plan before the destination is
+// modified, so rendering errors never leave a partially written tree.
 func Copy(source fs.FS, dest Writer, opts Options) (Stats, error) {
-	var stats Stats
+	return CopyContext(context.Background(), source, dest, opts)
+}
 
-	if source == nil {
-		return stats, fmt.Errorf("renderfs: source filesystem is required")
-	}
+// CopyContext is like Copy but stops as soon as ctx is done. The returned
+// error is a RenderError of kind RenderErrorCanceled wrapping ctx.Err(), and
+// Stats reports the files written before cancellation.
+func CopyContext(ctx context.Context, source fs.FS, dest Writer, opts Options) (Stats, error) {
 	if dest == nil {
-		return stats, fmt.Errorf("renderfs: destination writer is required")
+		return Stats{}, fmt.Errorf("renderfs: destination writer is required")
 	}
 
-	context := opts.Context
-	if context == nil {
-		context = map[string]any{}
-	}
-	env := opts.Environment
-
-	conflict := opts.OnConflict
-	if conflict < Overwrite || conflict > Fail {
-		conflict = Overwrite
-	}
-
-	matcher, err := buildIgnoreMatcher(source, opts.IgnorePatterns)
+	plan, err := PlanContext(ctx, source, dest, opts)
 	if err != nil {
-		return stats, err
+		return Stats{}, err
 	}
+	return ApplyContext(ctx, plan, dest)
+}
 
-	err = fs.WalkDir(source, ".", func(rel string, d fs.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
-		}
-		if rel == "." {
-			return nil
-		}
-
-		if matcher != nil && matcher.MatchesPath(rel) {
-			if d.IsDir() {
-				return fs.SkipDir
-			}
-			return nil
-		}
-
-		if rel == ".renderfs-ignore" {
-			if d.IsDir() {
-				return fs.SkipDir
-			}
-			return nil
-		}
-
-		info, err := d.Info()
-		if err != nil {
-			return fmt.Errorf("renderfs: stat %s: %w", rel, err)
+// checkDestination classifies a file of the given size, whose content is read
+// through open, against the existing destination file. Sizes are compared
+// first when dest implements LstatWriter; otherwise both sides are streamed
+// and compared chunk by chunk. The boolean result reports that an existing
+// symlink has to be removed before writing under ReplaceSymlinks.
+func checkDestination(dest Writer, path string, size int64, open func() (io.ReadCloser, error), conflict ConflictResolution, symlinks SymlinkPolicy) (OperationKind, bool, error) {
+	differs := false
+	if lw, ok := dest.(LstatWriter); ok {
+		info, err := lw.Lstat(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return OpCreate, false, nil
+		case err == nil && info.Mode()&fs.ModeSymlink != 0 && symlinks == FailOnSymlinks:
+			return "", false, &RenderError{Kind: RenderErrorSymlink, Path: path}
+		case err == nil && info.Mode()&fs.ModeSymlink != 0 && symlinks == ReplaceSymlinks:
+			kind, err := resolveConflict(path, conflict)
+			return kind, kind == OpUpdate, err
+		case err == nil && info.Mode().IsRegular() && info.Size() != size:
+			differs = true
 		}
+	}
 
-		renderedRel, skip, err := RenderPathWithEnv(rel, d.IsDir(), context, opts.StrictVariables, env)
+	if !differs {
+		existing, err := dest.Open(path)
 		if err != nil {
-			return &RenderError{Kind: RenderErrorPath, Path: rel, Err: err}
-		}
-		if skip {
-			if d.IsDir() {
-				return fs.SkipDir
-			}
-			return nil
-		}
-
-		if info.Mode()&fs.ModeSymlink != 0 {
-			target, err := readSymlink(source, rel)
-			if err != nil {
-				return fmt.Errorf("renderfs: read symlink %s: %w", rel, err)
+			if errors.Is(err, fs.ErrNotExist) {
+				return OpCreate, false, nil
 			}
-			if err := dest.Symlink(target, renderedRel); err != nil {
-				return fmt.Errorf("renderfs: create symlink %s -> %s: %w", renderedRel, target, err)
-			}
-			if d.IsDir() {
-				return fs.SkipDir
-			}
-			return nil
-		}
-
-		if d.IsDir() {
-			return dest.MkdirAll(renderedRel, directoryMode(info))
+			return "", false, fmt.Errorf("renderfs: check destination %s: %w", path, err)
 		}
+		defer existing.Close()
 
-		rawContent, err := fs.ReadFile(source, rel)
+		content, err := open()
 		if err != nil {
-			return fmt.Errorf("renderfs: read %s: %w", rel, err)
+			return "", false, err
 		}
+		defer content.Close()
 
-		finalBytes, err := RenderBytesWithEnv(rawContent, context, opts.TemplateBinary, opts.StrictVariables, env)
+		same, err := sameContent(existing, content)
 		if err != nil {
-			return &RenderError{Kind: RenderErrorFile, Path: rel, Err: err}
+			return "", false, fmt.Errorf("renderfs: read existing %s: %w", path, err)
 		}
-
-		status, err := checkDestination(dest, renderedRel, finalBytes, conflict)
-		if err != nil {
-			return err
+		if same {
+			return OpIdentical, false, nil
 		}
+	}
 
-		switch status {
-		case statusIdentical:
-			stats.Identical++
-			return nil
-		case statusSkip:
-			stats.Skipped++
-			return nil
-		case statusUpdate:
-			stats.Updated++
-		case statusCreate:
-			stats.Created++
-		}
+	kind, err := resolveConflict(path, conflict)
+	return kind, false, err
+}
 
-		if parent := path.Dir(renderedRel); parent != "." {
-			if err := dest.MkdirAll(parent, 0o755); err != nil {
-				return fmt.Errorf("renderfs: create parent %s: %w", parent, err)
-			}
-		}
+// resolveConflict returns the operation kind for a destination entry at path
+// that differs from the source.
+func resolveConflict(path string, conflict ConflictResolution) (OperationKind, error) {
+	switch conflict {
+	case Skip:
+		return OpSkip, nil
+	case Fail:
+		return "", &RenderError{Kind: RenderErrorConflict, Path: path}
+	case Overwrite:
+		return OpUpdate, nil
+	default:
+		return OpUpdate, nil
+	}
+}
 
-		handle, err := dest.CreateFile(renderedRel, fileMode(info))
-		if err != nil {
-			return fmt.Errorf("renderfs: create %s: %w", renderedRel, err)
-		}
+// compareChunkSize is the number of bytes sameContent reads from each side at
+// a time.
+const compareChunkSize = 32 << 10
 
-		_, writeErr := handle.Write(finalBytes)
-		closeErr := handle.Close()
-		if writeErr != nil {
-			return fmt.Errorf("renderfs: write %s: %w", renderedRel, writeErr)
+// sameContent reports whether a and b yield identical bytes.
+func sameContent(a, b io.Reader) (bool, error) {
+	bufA := make([]byte, compareChunkSize)
+	bufB := make([]byte, compareChunkSize)
+	for {
+		nA, errA := io.ReadFull(a, bufA)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return false, errA
 		}
-		if closeErr != nil {
-			return fmt.Errorf("renderfs: close %s: %w", renderedRel, closeErr)
+		nB, errB := io.ReadFull(b, bufB)
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return false, errB
 		}
-
-		return nil
-	})
-
-	return stats, err
-}
-
-type fileStatus int
-
-const (
-	statusCreate fileStatus = iota
-	statusUpdate
-	statusSkip
-	statusIdentical
-)
-
-func checkDestination(dest Writer, path string, newContent []byte, conflict ConflictResolution) (fileStatus, error) {
-	existing, err := dest.Open(path)
-	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			return statusCreate, nil
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+		doneA, doneB := errA != nil, errB != nil
+		if doneA || doneB {
+			return doneA && doneB, nil
 		}
-		return 0, fmt.Errorf("renderfs: check destination %s: %w", path, err)
-	}
-	defer existing.Close()
-
-	oldContent, err := io.ReadAll(existing)
-	if err != nil {
-		return 0, fmt.Errorf("renderfs: read existing %s: %w", path, err)
 	}
+}
 
-	if bytes.Equal(oldContent, newContent) {
-		return statusIdentical, nil
-	}
+// defaultTemplateSuffixes are stripped from rendered file names unless
+// Options.TemplateSuffixes is set.
+var defaultTemplateSuffixes = []string{".jinja", ".tmpl"}
 
-	switch conflict {
-	case Skip:
-		return statusSkip, nil
-	case Fail:
-		return 0, &RenderError{Kind: RenderErrorConflict, Path: path}
-	case Overwrite:
-		return statusUpdate, nil
+// templateSuffixes returns the suffixes stripped from rendered file names.
+func (o Options) templateSuffixes() []string {
+	switch {
+	case len(o.TemplateSuffixes) > 0:
+		return o.TemplateSuffixes
+	case o.TemplateSuffixOnly:
+		return []string{".jinja"}
 	default:
-		return statusUpdate, nil
+		return defaultTemplateSuffixes
 	}
 }
 
-func stripTemplateSuffix(p string) string {
-	switch {
-	case strings.HasSuffix(p, ".jinja"):
-		return strings.TrimSuffix(p, ".jinja")
-	case strings.HasSuffix(p, ".tmpl"):
-		return strings.TrimSuffix(p, ".tmpl")
-	default:
-		return p
+// templateSuffix returns the first of suffixes that name ends with, or "".
+func templateSuffix(name string, suffixes []string) string {
+	for _, suffix := range suffixes {
+		if suffix != "" && strings.HasSuffix(name, suffix) {
+			return suffix
+		}
 	}
+	return ""
+}
+
+func stripTemplateSuffix(p string, suffixes []string) string {
+	return strings.TrimSuffix(p, templateSuffix(p, suffixes))
 }
 
 func directoryMode(info fs.FileInfo) fs.FileMode {
@@ -227,13 +184,16 @@ func readSymlink(source fs.FS, rel string) (string, error) {
 	return "", fmt.Errorf("renderfs: source filesystem does not support symlinks")
 }
 
+// sniffLen is the number of leading bytes isBinary inspects.
+const sniffLen = 512
+
 func isBinary(data []byte) bool {
 	if len(data) == 0 {
 		return false
 	}
 	sniff := data
-	if len(sniff) > 512 {
-		sniff = sniff[:512]
+	if len(sniff) > sniffLen {
+		sniff = sniff[:sniffLen]
 	}
 	mimeType := http.DetectContentType(sniff)
 	return !strings.HasPrefix(mimeType, "text/") &&
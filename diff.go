@@ -0,0 +1,451 @@
+package renderfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// DiffKind describes how a destination file changes.
+type DiffKind string
+
+const (
+	DiffCreate DiffKind = "create"
+	DiffUpdate DiffKind = "update"
+
+	// DiffOnlyInDestination marks a destination file the plan does not
+	// produce. Apply leaves such files in place.
+	DiffOnlyInDestination DiffKind = "only-in-destination"
+)
+
+// FileDiff holds the difference between the current and rendered content of
+// a single destination file.
+type FileDiff struct {
+	Kind DiffKind
+	Path string
+
+	// Binary reports whether either side was detected as binary. Binary diffs
+	// only contain a one-line summary.
+	Binary bool
+
+	// Unified holds the diff in unified format, including the ---/+++ headers.
+	// Created files and files only in the destination are diffed against
+	// /dev/null.
+	Unified string
+}
+
+// DiffOptions configures Diff.
+type DiffOptions struct {
+	// Context is the number of unchanged lines shown around each change.
+	// Defaults to 3 when zero or negative.
+	Context int
+
+	// IncludeOnlyInDestination also reports destination files the plan does
+	// not produce, as DiffOnlyInDestination diffs against /dev/null. It
+	// requires a destination that implements Lister.
+	IncludeOnlyInDestination bool
+}
+
+// Lister is implemented by writers that can enumerate the files they hold.
+type Lister interface {
+	// List returns the slash-separated paths of all files relative to the
+	// writer's root, in lexical order.
+	List() ([]string, error)
+}
+
+// Diff compares every file the plan creates or updates with the content
+// currently returned by dest.Open and returns one FileDiff per changed file.
+// Files planned as identical or skipped are omitted, and files replacing a
+// destination symlink are diffed as new.
+func Diff(plan *ChangePlan, dest Writer, opts DiffOptions) ([]FileDiff, error) {
+	if plan == nil {
+		return nil, fmt.Errorf("renderfs: plan is required")
+	}
+
+	var diffs []FileDiff
+	produced := make(map[string]bool, len(plan.Operations))
+	for _, op := range plan.Operations {
+		produced[op.Path] = true
+
+		if op.Kind != OpCreate && op.Kind != OpUpdate {
+			continue
+		}
+
+		// A replaced symlink is removed before writing, so the file is new.
+		kind := DiffCreate
+		var existing io.ReadCloser
+		if op.Kind == OpUpdate && !op.Replace {
+			if dest == nil {
+				return nil, fmt.Errorf("renderfs: destination writer is required to diff %s", op.Path)
+			}
+			var err error
+			if existing, err = openDestination(dest, op.Path); err != nil {
+				return nil, err
+			}
+			kind = DiffUpdate
+		}
+		d, err := diffOperation(plan, op, kind, existing, opts.Context)
+		if existing != nil {
+			existing.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, d)
+	}
+
+	if !opts.IncludeOnlyInDestination {
+		return diffs, nil
+	}
+
+	lister, ok := dest.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("renderfs: destination writer cannot list files")
+	}
+	listed, err := lister.List()
+	if err != nil {
+		return nil, fmt.Errorf("renderfs: list destination: %w", err)
+	}
+	sort.Strings(listed)
+	for _, p := range listed {
+		if produced[p] {
+			continue
+		}
+		existing, err := openDestination(dest, p)
+		if err != nil {
+			return nil, err
+		}
+		d, err := DiffReaders(DiffOnlyInDestination, p, existing, nil, opts.Context)
+		if existing != nil {
+			existing.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, d)
+	}
+
+	return diffs, nil
+}
+
+// diffOperation diffs the content op writes against existing, which is nil
+// when there is nothing to compare with.
+func diffOperation(plan *ChangePlan, op Operation, kind DiffKind, existing io.Reader, context int) (FileDiff, error) {
+	content, err := plan.open(op)
+	if err != nil {
+		return FileDiff{}, err
+	}
+	defer content.Close()
+	return DiffReaders(kind, op.Path, existing, content, context)
+}
+
+// openDestination opens the destination file at p, returning nil when it
+// does not exist.
+func openDestination(dest Writer, p string) (io.ReadCloser, error) {
+	existing, err := dest.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("renderfs: open existing %s: %w", p, err)
+	}
+	return existing, nil
+}
+
+// DiffReaders is like NewFileDiff but reads the content from oldContent and
+// newContent, either of which may be nil for a missing file. Only the first
+// 512 bytes of each are read until both are known to be text, so binary
+// files of any size are summarized without being loaded.
+func DiffReaders(kind DiffKind, p string, oldContent, newContent io.Reader, context int) (FileDiff, error) {
+	switch kind {
+	case DiffCreate:
+		oldContent = nil
+	case DiffOnlyInDestination:
+		newContent = nil
+	}
+
+	oldHead, err := readHead(oldContent)
+	if err != nil {
+		return FileDiff{}, fmt.Errorf("renderfs: read existing %s: %w", p, err)
+	}
+	newHead, err := readHead(newContent)
+	if err != nil {
+		return FileDiff{}, fmt.Errorf("renderfs: read %s: %w", p, err)
+	}
+	if isBinary(oldHead) || isBinary(newHead) {
+		return NewFileDiff(kind, p, oldHead, newHead, context), nil
+	}
+
+	oldText, err := readRest(oldHead, oldContent)
+	if err != nil {
+		return FileDiff{}, fmt.Errorf("renderfs: read existing %s: %w", p, err)
+	}
+	newText, err := readRest(newHead, newContent)
+	if err != nil {
+		return FileDiff{}, fmt.Errorf("renderfs: read %s: %w", p, err)
+	}
+	return NewFileDiff(kind, p, oldText, newText, context), nil
+}
+
+// readHead reads up to the sniffLen bytes isBinary inspects from r, which
+// may be nil.
+func readHead(r io.Reader) ([]byte, error) {
+	if r == nil {
+		return nil, nil
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// readRest returns head followed by whatever r holds after it.
+func readRest(head []byte, r io.Reader) ([]byte, error) {
+	if r == nil || len(head) < sniffLen {
+		return head, nil
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(head, rest...), nil
+}
+
+// NewFileDiff builds the FileDiff for a single file. oldContent is ignored for
+// DiffCreate and newContent for DiffOnlyInDestination. context is the number
+// of unchanged lines around each change and defaults to 3 when zero or
+// negative.
+func NewFileDiff(kind DiffKind, p string, oldContent, newContent []byte, context int) FileDiff {
+	if context <= 0 {
+		context = 3
+	}
+
+	oldName, newName := "a/"+p, "b/"+p
+	switch kind {
+	case DiffCreate:
+		oldName, oldContent = "/dev/null", nil
+	case DiffOnlyInDestination:
+		newName, newContent = "/dev/null", nil
+	}
+
+	d := FileDiff{Kind: kind, Path: p}
+	if isBinary(oldContent) || isBinary(newContent) {
+		d.Binary = true
+		d.Unified = fmt.Sprintf("Binary files %s and %s differ\n", oldName, newName)
+		return d
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+	writeHunks(&b, splitLines(string(oldContent)), splitLines(string(newContent)), context)
+	d.Unified = b.String()
+	return d
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// maxDiffEdits bounds the number of edits diffLines searches for. Beyond it
+// the lines between the common prefix and suffix are reported as a single
+// replacement, which keeps the search within O(maxDiffEdits²) memory.
+const maxDiffEdits = 1000
+
+// diffLines computes a shortest edit script between a and b using Myers'
+// algorithm.
+func diffLines(a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	lines := make([]diffLine, 0, len(a)+len(b)-prefix-suffix)
+	for _, text := range a[:prefix] {
+		lines = append(lines, diffLine{op: ' ', text: text})
+	}
+	lines = append(lines, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, text := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{op: ' ', text: text})
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return lines
+}
+
+// diffMiddle runs the Myers search on a and b. Each step of the trace only
+// keeps the diagonals it reached, so memory grows with the square of the edit
+// distance rather than with the length of the input.
+func diffMiddle(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return replaceLines(a, b)
+	}
+
+	offset := n + m
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+
+search:
+	for d := 0; d <= offset; d++ {
+		if d > maxDiffEdits {
+			return replaceLines(a, b)
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	lines := make([]diffLine, 0, n+m)
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		// trace[d] holds the diagonals -d through d before step d.
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[k-1+d] < v[k+1+d]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = v[prevK+d]
+		}
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			lines = append(lines, diffLine{op: ' ', text: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				lines = append(lines, diffLine{op: '+', text: b[y-1]})
+			} else {
+				lines = append(lines, diffLine{op: '-', text: a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// replaceLines is the edit script removing every line of a, then adding every
+// line of b.
+func replaceLines(a, b []string) []diffLine {
+	lines := make([]diffLine, 0, len(a)+len(b))
+	for _, text := range a {
+		lines = append(lines, diffLine{op: '-', text: text})
+	}
+	for _, text := range b {
+		lines = append(lines, diffLine{op: '+', text: text})
+	}
+	return lines
+}
+
+func writeHunks(b *strings.Builder, a, bLines []string, context int) {
+	lines := diffLines(a, bLines)
+
+	// oldAt and newAt hold the number of old and new lines preceding each
+	// script entry.
+	oldAt := make([]int, len(lines)+1)
+	newAt := make([]int, len(lines)+1)
+	for i, l := range lines {
+		oldAt[i+1], newAt[i+1] = oldAt[i], newAt[i]
+		if l.op != '+' {
+			oldAt[i+1]++
+		}
+		if l.op != '-' {
+			newAt[i+1]++
+		}
+	}
+
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			i++
+			continue
+		}
+
+		start := max(i-context, 0)
+		end := i
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(lines) && lines[next].op == ' ' {
+				next++
+			}
+			if next == len(lines) || next-end > 2*context {
+				end = min(end+context, len(lines))
+				break
+			}
+			end = next
+		}
+
+		oldCount := oldAt[end] - oldAt[start]
+		newCount := newAt[end] - newAt[start]
+		fmt.Fprintf(b, "@@ -%s +%s @@\n", hunkRange(oldAt[start], oldCount), hunkRange(newAt[start], newCount))
+		for _, l := range lines[start:end] {
+			b.WriteByte(l.op)
+			b.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+}
+
+func hunkRange(before, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", before)
+	case 1:
+		return fmt.Sprintf("%d", before+1)
+	default:
+		return fmt.Sprintf("%d,%d", before+1, count)
+	}
+}
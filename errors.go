@@ -5,15 +5,22 @@ import "fmt"
 type RenderErrorKind string
 
 const (
-	RenderErrorPath     RenderErrorKind = "path"
-	RenderErrorFile     RenderErrorKind = "file"
-	RenderErrorConflict RenderErrorKind = "conflict"
+	RenderErrorPath      RenderErrorKind = "path"
+	RenderErrorFile      RenderErrorKind = "file"
+	RenderErrorConflict  RenderErrorKind = "conflict"
+	RenderErrorCanceled  RenderErrorKind = "canceled"
+	RenderErrorSymlink   RenderErrorKind = "symlink"
+	RenderErrorCollision RenderErrorKind = "collision"
 )
 
 type RenderError struct {
 	Kind RenderErrorKind
 	Path string
 	Err  error
+
+	// Other is the source path that Path collides with for
+	// RenderErrorCollision errors.
+	Other string
 }
 
 func (e *RenderError) Error() string {
@@ -33,6 +40,18 @@ func (e *RenderError) Error() string {
 		return fmt.Sprintf("renderfs: render file %s", e.Path)
 	case RenderErrorConflict:
 		return fmt.Sprintf("renderfs: destination file %s exists and differs", e.Path)
+	case RenderErrorSymlink:
+		return fmt.Sprintf("renderfs: destination file %s is a symlink", e.Path)
+	case RenderErrorCollision:
+		if e.Err != nil {
+			return fmt.Sprintf("renderfs: %s and %s collide: %v", e.Other, e.Path, e.Err)
+		}
+		return fmt.Sprintf("renderfs: %s and %s render to the same destination path", e.Other, e.Path)
+	case RenderErrorCanceled:
+		if e.Err != nil {
+			return fmt.Sprintf("renderfs: canceled at %s: %v", e.Path, e.Err)
+		}
+		return fmt.Sprintf("renderfs: canceled at %s", e.Path)
 	default:
 		if e.Err != nil {
 			return fmt.Sprintf("renderfs: %s: %v", e.Path, e.Err)
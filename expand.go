@@ -0,0 +1,135 @@
+package renderfs
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// expansion describes a path segment consisting of a single for loop, such as
+// "{% for svc in services %}{{ svc.name }}{% endfor %}". The directory or file
+// is planned once per element of the list, with the loop variable added to
+// the context of everything beneath it.
+type expansion struct {
+	variable string
+	iterable string // dotted lookup in the context, such as "services" or "app.services"
+	body     string // template rendering the name for one element
+}
+
+// expansionPattern matches expansion segments written with the block
+// delimiters of r.
+func expansionPattern(r *Renderer) *regexp.Regexp {
+	cfg := r.config()
+	start := regexp.QuoteMeta(cfg.BlockStartString)
+	end := regexp.QuoteMeta(cfg.BlockEndString)
+	ident := `[A-Za-z_][A-Za-z0-9_]*`
+	return regexp.MustCompile(`^` + start + `-?\s*for\s+(` + ident + `)\s+in\s+(` + ident + `(?:\.` + ident + `)*)\s*-?` + end +
+		`(.*)` + start + `-?\s*endfor\s*-?` + end + `$`)
+}
+
+// parseExpansion reports whether the name of the source entry rel is an
+// expansion segment, written with the delimiters of rel.
+func (p *planner) parseExpansion(rel string) (expansion, bool) {
+	m := p.templatesFor(rel).expansion.FindStringSubmatch(path.Base(rel))
+	if m == nil {
+		return expansion{}, false
+	}
+	return expansion{variable: m[1], iterable: m[2], body: m[3]}, true
+}
+
+// expand plans rel, whose name is an expansion segment, once per element of
+// the list it iterates. Names rendering empty are skipped; directories are
+// walked again for every element.
+func (p *planner) expand(scope walkScope, rel string, info fs.FileInfo, spec expansion) error {
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return &RenderError{Kind: RenderErrorPath, Path: rel, Err: fmt.Errorf("renderfs: path expansion is only supported for files and directories")}
+	}
+	skipResult := error(nil)
+	if info.IsDir() {
+		skipResult = fs.SkipDir
+	}
+
+	parent := scope.dest
+	if dir := path.Dir(rel); dir != scope.source {
+		rendered, skip, err := p.renderRel(scope, dir, true)
+		if err != nil {
+			return &RenderError{Kind: RenderErrorPath, Path: rel, Err: err}
+		}
+		if skip {
+			return skipResult
+		}
+		parent = rendered
+	}
+
+	items, err := p.lookupList(scope.vars, spec.iterable)
+	if err != nil {
+		return &RenderError{Kind: RenderErrorPath, Path: rel, Err: err}
+	}
+
+	for _, item := range items {
+		vars := maps.Clone(scope.vars)
+		vars[spec.variable] = item
+
+		name, err := p.templatesFor(rel).paths.RenderString(spec.body, vars)
+		if err != nil {
+			return &RenderError{Kind: RenderErrorPath, Path: rel, Err: err}
+		}
+		elem, skip, err := normalizeRenderedPath(name, info.IsDir(), p.suffixes)
+		if err != nil {
+			return &RenderError{Kind: RenderErrorPath, Path: rel, Err: err}
+		}
+		if skip {
+			continue
+		}
+		renderedRel := path.Join(parent, elem)
+
+		if err := p.addEntry(rel, renderedRel, info, vars); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			child := walkScope{source: rel, dest: renderedRel, vars: vars}
+			if err := fs.WalkDir(p.source, rel, p.visitor(child)); err != nil {
+				return err
+			}
+		}
+	}
+	return skipResult
+}
+
+// lookupList resolves a dotted name in vars to the elements of a slice or
+// array. Undefined names yield no elements unless strict variables are
+// enabled.
+func (p *planner) lookupList(vars map[string]any, name string) ([]any, error) {
+	var value any = vars
+	for _, key := range strings.Split(name, ".") {
+		v := reflect.ValueOf(value)
+		if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("renderfs: cannot look up %q in %s: not a mapping", key, name)
+		}
+		entry := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+		if !entry.IsValid() {
+			if p.renderer.strict {
+				return nil, fmt.Errorf("renderfs: %s is undefined", name)
+			}
+			return nil, nil
+		}
+		value = entry.Interface()
+	}
+
+	if value == nil {
+		return nil, nil
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("renderfs: %s is not a list", name)
+	}
+	items := make([]any, v.Len())
+	for i := range items {
+		items[i] = v.Index(i).Interface()
+	}
+	return items, nil
+}
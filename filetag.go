@@ -0,0 +1,124 @@
+package renderfs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nikolalohinski/gonja/v2/exec"
+	"github.com/nikolalohinski/gonja/v2/nodes"
+	"github.com/nikolalohinski/gonja/v2/parser"
+	"github.com/nikolalohinski/gonja/v2/tokens"
+)
+
+// fileCollectorKey is the context variable holding the fileCollector of the
+// file being rendered by Plan.
+const fileCollectorKey = "__renderfs_files"
+
+// emittedFile is the output of one {% file %} block.
+type emittedFile struct {
+	path string
+	data []byte
+}
+
+// fileCollector gathers the files emitted by a template in render order.
+type fileCollector struct {
+	mu    sync.Mutex
+	files []emittedFile
+}
+
+func (c *fileCollector) add(p string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files = append(c.files, emittedFile{path: p, data: data})
+}
+
+// fileControlStructure implements {% file path %}...{% endfile %}. The body is
+// rendered into a separate output file named by the path expression instead
+// of the template's own output.
+type fileControlStructure struct {
+	position *tokens.Token
+	path     nodes.Expression
+	body     *nodes.Wrapper
+}
+
+func (cs *fileControlStructure) Position() *tokens.Token {
+	return cs.position
+}
+
+func (cs *fileControlStructure) String() string {
+	t := cs.Position()
+	return fmt.Sprintf("FileControlStructure(Line=%d Col=%d)", t.Line, t.Col)
+}
+
+func (cs *fileControlStructure) Execute(r *exec.Renderer, tag *nodes.ControlStructureBlock) error {
+	value, ok := r.Environment.Context.Get(fileCollectorKey)
+	collector, isCollector := value.(*fileCollector)
+	if !ok || !isCollector {
+		return fmt.Errorf("renderfs: the file tag is only available in templates rendered by Copy or Plan (line %d)", cs.position.Line)
+	}
+
+	name := r.Eval(cs.path)
+	if name.IsError() {
+		return fmt.Errorf("renderfs: evaluate file path (line %d): %s", cs.position.Line, name.Error())
+	}
+
+	var out strings.Builder
+	sub := r.Inherit()
+	sub.Output = &out
+	if err := sub.ExecuteWrapper(cs.body); err != nil {
+		return err
+	}
+
+	collector.add(name.String(), []byte(out.String()))
+	return nil
+}
+
+func fileParser(p *parser.Parser, args *parser.Parser) (nodes.ControlStructure, error) {
+	cs := &fileControlStructure{position: p.Current()}
+
+	expr, err := args.ParseExpression()
+	if err != nil {
+		return nil, err
+	}
+	cs.path = expr
+	if !args.End() {
+		return nil, args.Error("Malformed file-tag args.", args.Current())
+	}
+
+	wrapper, endargs, err := p.WrapUntil("endfile")
+	if err != nil {
+		return nil, err
+	}
+	if !endargs.End() {
+		return nil, endargs.Error("Arguments not allowed here.", nil)
+	}
+	cs.body = wrapper
+
+	return cs, nil
+}
+
+// withFileTag returns a copy of r whose environment also provides the file
+// tag. It is used for file contents only, so templates cached for paths keep
+// the environment they were compiled with.
+func (r *Renderer) withFileTag() *Renderer {
+	if r.env.ControlStructures.Exists("file") {
+		return r
+	}
+
+	derived := *r
+	derived.env = r.cache.environment(r.env, "file", func() *exec.Environment {
+		structures := exec.NewControlStructureSet(map[string]parser.ControlStructureParser{}).Update(r.env.ControlStructures)
+		if err := structures.Register("file", fileParser); err != nil {
+			return r.env
+		}
+		return &exec.Environment{
+			Context:           r.env.Context,
+			Filters:           r.env.Filters,
+			Tests:             r.env.Tests,
+			ControlStructures: structures,
+			Methods:           r.env.Methods,
+		}
+	})
+	return &derived
+}
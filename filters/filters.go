@@ -0,0 +1,394 @@
+// Package filters provides Gonja filters commonly needed when scaffolding
+// projects: case conversions, serialization, hashing and quoting.
+//
+// Register adds them to an environment; renderfs.Options.BuiltinFilters
+// enables them for Copy and Plan without touching any environment.
+package filters
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nikolalohinski/gonja/v2/exec"
+	"gopkg.in/yaml.v3"
+)
+
+// Filters returns the filters of this package by name. The map is a new copy
+// on every call.
+func Filters() map[string]exec.FilterFunction {
+	return map[string]exec.FilterFunction{
+		"snake_case":    stringFilter("snake_case", snakeCase),
+		"camel_case":    stringFilter("camel_case", camelCase),
+		"pascal_case":   stringFilter("pascal_case", pascalCase),
+		"kebab_case":    stringFilter("kebab_case", kebabCase),
+		"slugify":       stringFilter("slugify", slugify),
+		"pluralize":     filterPluralize,
+		"to_json":       filterToJSON,
+		"to_yaml":       filterToYAML,
+		"to_toml":       filterToTOML,
+		"b64encode":     stringFilter("b64encode", b64encode),
+		"sha256":        stringFilter("sha256", sha256Hex),
+		"regex_replace": filterRegexReplace,
+		"indent":        filterIndent,
+		"quote":         stringFilter("quote", strconv.Quote),
+		"go_identifier": filterGoIdentifier,
+	}
+}
+
+// Register adds the filters to env, replacing filters of the same name, such
+// as Gonja's own indent. Register modifies env, so it should not be called on
+// gonja.DefaultEnvironment or on an environment that is in use.
+func Register(env *exec.Environment) {
+	env.Filters.Update(exec.NewFilterSet(Filters()))
+}
+
+// stringFilter adapts fn, taking no arguments, to a filter.
+func stringFilter(name string, fn func(string) string) exec.FilterFunction {
+	return func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+		if in.IsError() {
+			return in
+		}
+		if p := params.ExpectNothing(); p.IsError() {
+			return exec.AsValue(fmt.Errorf("wrong signature for '%s': %s", name, p.Error()))
+		}
+		return exec.AsValue(fn(in.String()))
+	}
+}
+
+// words splits s into words at non-alphanumeric characters and at case
+// changes, keeping acronyms together: "HTTPServer_v2" yields "HTTP",
+// "Server" and "v2".
+func words(s string) []string {
+	var out []string
+	var current []rune
+	runes := []rune(s)
+	flush := func() {
+		if len(current) > 0 {
+			out = append(out, string(current))
+			current = current[:0]
+		}
+	}
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			flush()
+			continue
+		}
+		if unicode.IsUpper(r) && len(current) > 0 {
+			prev := current[len(current)-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || unicode.IsUpper(prev) && nextLower {
+				flush()
+			}
+		}
+		current = append(current, r)
+	}
+	flush()
+	return out
+}
+
+func title(word string) string {
+	runes := []rune(strings.ToLower(word))
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+func joinLower(s, sep string) string {
+	parts := words(s)
+	for i, w := range parts {
+		parts[i] = strings.ToLower(w)
+	}
+	return strings.Join(parts, sep)
+}
+
+func snakeCase(s string) string { return joinLower(s, "_") }
+
+func kebabCase(s string) string { return joinLower(s, "-") }
+
+func pascalCase(s string) string {
+	var b strings.Builder
+	for _, w := range words(s) {
+		b.WriteString(title(w))
+	}
+	return b.String()
+}
+
+func camelCase(s string) string {
+	var b strings.Builder
+	for i, w := range words(s) {
+		if i == 0 {
+			b.WriteString(strings.ToLower(w))
+			continue
+		}
+		b.WriteString(title(w))
+	}
+	return b.String()
+}
+
+// slugify lowercases s and replaces every run of characters other than
+// letters and digits with a single hyphen.
+func slugify(s string) string {
+	var b strings.Builder
+	pending := false
+	for _, r := range strings.ToLower(s) {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			pending = b.Len() > 0
+			continue
+		}
+		if pending {
+			b.WriteByte('-')
+			pending = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func b64encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+var irregularPlurals = map[string]string{
+	"child":  "children",
+	"foot":   "feet",
+	"man":    "men",
+	"mouse":  "mice",
+	"person": "people",
+	"tooth":  "teeth",
+	"woman":  "women",
+}
+
+// pluralize returns the English plural of a singular noun.
+func pluralize(word string) string {
+	lower := strings.ToLower(word)
+	if plural, ok := irregularPlurals[lower]; ok {
+		if word != lower {
+			return title(plural)
+		}
+		return plural
+	}
+	switch {
+	case lower == "":
+		return word
+	case strings.HasSuffix(lower, "s"), strings.HasSuffix(lower, "x"), strings.HasSuffix(lower, "z"),
+		strings.HasSuffix(lower, "ch"), strings.HasSuffix(lower, "sh"):
+		return word + "es"
+	case strings.HasSuffix(lower, "y") && len(lower) > 1 && !strings.ContainsRune("aeiou", rune(lower[len(lower)-2])):
+		return word[:len(word)-1] + "ies"
+	default:
+		return word + "s"
+	}
+}
+
+// filterPluralize implements pluralize(count=None): the word is returned
+// unchanged when count is 1.
+func filterPluralize(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+	p := params.Expect(0, []*exec.KwArg{{Name: "count", Default: nil}})
+	if p.IsError() {
+		return exec.AsValue(fmt.Errorf("wrong signature for 'pluralize': %s", p.Error()))
+	}
+	if count := p.KwArgs["count"]; !count.IsNil() {
+		if !count.IsInteger() {
+			return exec.AsValue(fmt.Errorf("pluralize: count %s is not an integer", count.String()))
+		}
+		if count.Integer() == 1 {
+			return exec.AsValue(in.String())
+		}
+	}
+	return exec.AsValue(pluralize(in.String()))
+}
+
+// simpleValue converts in to maps with string keys, slices and scalars.
+func simpleValue(in *exec.Value) (any, error) {
+	casted := in.ToGoSimpleType(false)
+	if err, ok := casted.(error); ok {
+		return nil, err
+	}
+	return casted, nil
+}
+
+// filterToJSON implements to_json(indent=None).
+func filterToJSON(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+	var indent int
+	if err := params.Take(
+		exec.KeywordArgument("indent", exec.AsValue(0), exec.IntArgument(&indent)),
+	); err != nil {
+		return exec.AsValue(fmt.Errorf("wrong signature for 'to_json': %w", err))
+	}
+	value, err := simpleValue(in)
+	if err != nil {
+		return exec.AsValue(err)
+	}
+	var out []byte
+	if indent > 0 {
+		out, err = json.MarshalIndent(value, "", strings.Repeat(" ", indent))
+	} else {
+		out, err = json.Marshal(value)
+	}
+	if err != nil {
+		return exec.AsValue(fmt.Errorf("to_json: %w", err))
+	}
+	return exec.AsSafeValue(string(out))
+}
+
+// filterToYAML implements to_yaml(indent=2). The final newline is removed.
+func filterToYAML(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+	indent := 2
+	if err := params.Take(
+		exec.KeywordArgument("indent", exec.AsValue(2), exec.IntArgument(&indent)),
+	); err != nil {
+		return exec.AsValue(fmt.Errorf("wrong signature for 'to_yaml': %w", err))
+	}
+	value, err := simpleValue(in)
+	if err != nil {
+		return exec.AsValue(err)
+	}
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(indent)
+	if err := encoder.Encode(value); err != nil {
+		return exec.AsValue(fmt.Errorf("to_yaml: %w", err))
+	}
+	if err := encoder.Close(); err != nil {
+		return exec.AsValue(fmt.Errorf("to_yaml: %w", err))
+	}
+	return exec.AsSafeValue(strings.TrimSuffix(buf.String(), "\n"))
+}
+
+// filterToTOML implements to_toml for mappings. The final newline is
+// removed.
+func filterToTOML(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+	if p := params.ExpectNothing(); p.IsError() {
+		return exec.AsValue(fmt.Errorf("wrong signature for 'to_toml': %s", p.Error()))
+	}
+	value, err := simpleValue(in)
+	if err != nil {
+		return exec.AsValue(err)
+	}
+	if _, ok := value.(map[string]any); !ok {
+		return exec.AsValue(fmt.Errorf("to_toml: %s is not a mapping", in.String()))
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(value); err != nil {
+		return exec.AsValue(fmt.Errorf("to_toml: %w", err))
+	}
+	return exec.AsSafeValue(strings.TrimSuffix(buf.String(), "\n"))
+}
+
+// filterRegexReplace implements regex_replace(pattern, replacement) with Go
+// regular expressions; the replacement may reference groups as $1 or
+// ${name}.
+func filterRegexReplace(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+	var pattern, replacement string
+	if err := params.Take(
+		exec.PositionalArgument("pattern", nil, exec.StringArgument(&pattern)),
+		exec.PositionalArgument("replacement", nil, exec.StringArgument(&replacement)),
+	); err != nil {
+		return exec.AsValue(fmt.Errorf("wrong signature for 'regex_replace': %w", err))
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return exec.AsValue(fmt.Errorf("regex_replace: %w", err))
+	}
+	return exec.AsValue(re.ReplaceAllString(in.String(), replacement))
+}
+
+// filterIndent implements indent(width=4, first=False, blank=False) like
+// Jinja: every line but the first is indented by width spaces, or by width
+// itself when it is a string. Blank lines are left alone unless blank is
+// set.
+func filterIndent(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+	p := params.Expect(0, []*exec.KwArg{
+		{Name: "width", Default: 4},
+		{Name: "first", Default: false},
+		{Name: "blank", Default: false},
+	})
+	if p.IsError() {
+		return exec.AsValue(fmt.Errorf("wrong signature for 'indent': %s", p.Error()))
+	}
+	width := p.KwArgs["width"]
+	var prefix string
+	switch {
+	case width.IsString():
+		prefix = width.String()
+	case width.IsInteger():
+		prefix = strings.Repeat(" ", width.Integer())
+	default:
+		return exec.AsValue(fmt.Errorf("indent: width %s is not an integer or a string", width.String()))
+	}
+	first := p.KwArgs["first"].IsTrue()
+	blank := p.KwArgs["blank"].IsTrue()
+
+	lines := strings.Split(in.String(), "\n")
+	for i, line := range lines {
+		if i == 0 && !first || strings.TrimSpace(line) == "" && !blank {
+			continue
+		}
+		lines[i] = prefix + line
+	}
+	return exec.AsValue(strings.Join(lines, "\n"))
+}
+
+// filterGoIdentifier implements go_identifier(exported=False): the words of
+// the value joined in camel case, or Pascal case when exported, prefixed with
+// an underscore when it would start with a digit and suffixed with one when
+// it is a Go keyword.
+func filterGoIdentifier(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+	p := params.Expect(0, []*exec.KwArg{{Name: "exported", Default: false}})
+	if p.IsError() {
+		return exec.AsValue(fmt.Errorf("wrong signature for 'go_identifier': %s", p.Error()))
+	}
+	return exec.AsValue(goIdentifier(in.String(), p.KwArgs["exported"].IsTrue()))
+}
+
+func goIdentifier(s string, exported bool) string {
+	id := camelCase(s)
+	if exported {
+		id = pascalCase(s)
+	}
+	switch {
+	case id == "":
+		return "_"
+	case unicode.IsDigit([]rune(id)[0]):
+		return "_" + id
+	case token.IsKeyword(id):
+		return id + "_"
+	default:
+		return id
+	}
+}
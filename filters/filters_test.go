@@ -0,0 +1,162 @@
+package filters
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nikolalohinski/gonja/v2"
+	"github.com/nikolalohinski/gonja/v2/config"
+	"github.com/nikolalohinski/gonja/v2/exec"
+	"github.com/nikolalohinski/gonja/v2/loaders"
+)
+
+func newEnvironment() *exec.Environment {
+	base := gonja.DefaultEnvironment
+	env := &exec.Environment{
+		Context:           base.Context,
+		Filters:           exec.NewFilterSet(map[string]exec.FilterFunction{}).Update(base.Filters),
+		Tests:             base.Tests,
+		ControlStructures: base.ControlStructures,
+		Methods:           base.Methods,
+	}
+	Register(env)
+	return env
+}
+
+func render(t *testing.T, env *exec.Environment, tpl string, vars map[string]any) (string, error) {
+	t.Helper()
+	loader := loaders.MustNewMemoryLoader(map[string]string{"/test": tpl})
+	compiled, err := exec.NewTemplate("/test", config.New(), loader, env)
+	if err != nil {
+		t.Fatalf("compile %q: %v", tpl, err)
+	}
+	return compiled.ExecuteToString(exec.NewContext(vars))
+}
+
+type filterCase struct {
+	name string
+	tpl  string
+	vars map[string]any
+	want string
+}
+
+func runCases(t *testing.T, cases []filterCase) {
+	t.Helper()
+	env := newEnvironment()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := render(t, env, tc.tpl, tc.vars)
+			if err != nil {
+				t.Fatalf("render %q: %v", tc.tpl, err)
+			}
+			if got != tc.want {
+				t.Fatalf("render %q: expected %q, got %q", tc.tpl, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCaseFilters(t *testing.T) {
+	runCases(t, []filterCase{
+		{"snake from camel", `{{ "userID" | snake_case }}`, nil, "user_id"},
+		{"snake from acronym", `{{ "HTTPServer" | snake_case }}`, nil, "http_server"},
+		{"snake from words", `{{ "Hello big-World" | snake_case }}`, nil, "hello_big_world"},
+		{"camel", `{{ "user_name" | camel_case }}`, nil, "userName"},
+		{"camel from pascal", `{{ "APIKey" | camel_case }}`, nil, "apiKey"},
+		{"pascal", `{{ "my-service v2" | pascal_case }}`, nil, "MyServiceV2"},
+		{"kebab", `{{ "MyService_name" | kebab_case }}`, nil, "my-service-name"},
+		{"digits stay in words", `{{ "oauth2Client" | kebab_case }}`, nil, "oauth2-client"},
+		{"empty", `{{ "" | snake_case }}`, nil, ""},
+	})
+}
+
+func TestSlugify(t *testing.T) {
+	runCases(t, []filterCase{
+		{"spaces and punctuation", `{{ "Hello, World!" | slugify }}`, nil, "hello-world"},
+		{"runs collapse", `{{ "  a -- b__c  " | slugify }}`, nil, "a-b-c"},
+		{"unicode letters kept", `{{ "Crème Brûlée" | slugify }}`, nil, "crème-brûlée"},
+	})
+}
+
+func TestPluralize(t *testing.T) {
+	runCases(t, []filterCase{
+		{"regular", `{{ "service" | pluralize }}`, nil, "services"},
+		{"sibilant", `{{ "box" | pluralize }}`, nil, "boxes"},
+		{"consonant y", `{{ "policy" | pluralize }}`, nil, "policies"},
+		{"vowel y", `{{ "key" | pluralize }}`, nil, "keys"},
+		{"irregular", `{{ "Person" | pluralize }}`, nil, "People"},
+		{"count of one", `{{ "user" | pluralize(n) }}`, map[string]any{"n": 1}, "user"},
+		{"count of many", `{{ "user" | pluralize(count=n) }}`, map[string]any{"n": 3}, "users"},
+	})
+}
+
+func TestSerializationFilters(t *testing.T) {
+	vars := map[string]any{
+		"app": map[string]any{"name": "demo", "ports": []int{80, 443}},
+	}
+	runCases(t, []filterCase{
+		{"json", `{{ app | to_json }}`, vars, `{"name":"demo","ports":[80,443]}`},
+		{"json indent", `{{ app.ports | to_json(indent=2) }}`, vars, "[\n  80,\n  443\n]"},
+		{"yaml", `{{ app | to_yaml }}`, vars, "name: demo\nports:\n  - 80\n  - 443"},
+		{"yaml indent", `{{ app | to_yaml(indent=4) }}`, vars, "name: demo\nports:\n    - 80\n    - 443"},
+		{"toml", `{{ app | to_toml }}`, vars, "name = \"demo\"\nports = [80, 443]"},
+	})
+
+	if _, err := render(t, newEnvironment(), `{{ [1, 2] | to_toml }}`, nil); err == nil {
+		t.Fatalf("expected to_toml to reject a list")
+	}
+}
+
+func TestEncodingFilters(t *testing.T) {
+	runCases(t, []filterCase{
+		{"b64encode", `{{ "hello" | b64encode }}`, nil, "aGVsbG8="},
+		{"sha256", `{{ "hello" | sha256 }}`, nil, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{"quote", `{{ name | quote }}`, map[string]any{"name": `say "hi"`}, `"say \"hi\""`},
+	})
+}
+
+func TestRegexReplace(t *testing.T) {
+	runCases(t, []filterCase{
+		{"groups", `{{ "v1.2.3" | regex_replace("^v(\\d+)\\..*$", "major $1") }}`, nil, "major 1"},
+		{"all matches", `{{ "a-b-c" | regex_replace("-", "_") }}`, nil, "a_b_c"},
+	})
+
+	if _, err := render(t, newEnvironment(), `{{ "x" | regex_replace("(", "") }}`, nil); err == nil {
+		t.Fatalf("expected regex_replace to reject an invalid pattern")
+	}
+}
+
+func TestIndent(t *testing.T) {
+	vars := map[string]any{"text": "a:\n  b: 1\n\nc: 2"}
+	runCases(t, []filterCase{
+		{"default", `{{ text | indent }}`, vars, "a:\n      b: 1\n\n    c: 2"},
+		{"width and first", `{{ text | indent(2, first=true) }}`, vars, "  a:\n    b: 1\n\n  c: 2"},
+		{"blank", `{{ text | indent(2, blank=true) }}`, vars, "a:\n    b: 1\n  \n  c: 2"},
+		{"string width", `{{ "x\ny" | indent("> ") }}`, nil, "x\n> y"},
+	})
+}
+
+func TestGoIdentifier(t *testing.T) {
+	runCases(t, []filterCase{
+		{"camel", `{{ "my-package" | go_identifier }}`, nil, "myPackage"},
+		{"exported", `{{ "my-package" | go_identifier(exported=true) }}`, nil, "MyPackage"},
+		{"keyword", `{{ "type" | go_identifier }}`, nil, "type_"},
+		{"leading digit", `{{ "3d-model" | go_identifier }}`, nil, "_3dModel"},
+		{"empty", `{{ "--" | go_identifier }}`, nil, "_"},
+	})
+}
+
+func TestRegisterReplacesFilters(t *testing.T) {
+	env := newEnvironment()
+	for name := range Filters() {
+		if !env.Filters.Exists(name) {
+			t.Fatalf("expected filter %s to be registered", name)
+		}
+	}
+	if gonja.DefaultEnvironment.Filters.Exists("snake_case") {
+		t.Fatalf("expected the default environment to be left alone")
+	}
+	if _, err := render(t, env, `{{ "x" | snake_case(1) }}`, nil); err == nil || !strings.Contains(err.Error(), "snake_case") {
+		t.Fatalf("expected signature error naming the filter, got %v", err)
+	}
+}
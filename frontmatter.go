@@ -0,0 +1,185 @@
+package renderfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// frontMatter holds the directives of a YAML block at the top of a file
+// template, such as
+//
+//	---
+//	output: "{{ name }}.conf"
+//	mode: 0755
+//	skip_if: not enabled
+//	on_conflict: skip
+//	render: false
+//	---
+//
+// The block is removed from the output.
+type frontMatter struct {
+	// Output is a path template replacing the rendered name of the file,
+	// relative to its rendered directory.
+	Output string `yaml:"output"`
+
+	// Mode overrides the permission bits of the file. It is always read as
+	// octal, with or without a leading 0 or 0o, so 644 and 0644 are the same.
+	Mode yaml.Node `yaml:"mode"`
+
+	// SkipIf is an expression evaluated against the context; the file is
+	// left out of the plan when it is true.
+	SkipIf string `yaml:"skip_if"`
+
+	// OnConflict overrides Options.OnConflict: "overwrite", "skip" or
+	// "fail".
+	OnConflict string `yaml:"on_conflict"`
+
+	// Render set to false copies the rest of the file without rendering it.
+	Render *bool `yaml:"render"`
+}
+
+// frontMatterKeys are the directives a front matter block may contain.
+var frontMatterKeys = map[string]bool{
+	"output":      true,
+	"mode":        true,
+	"skip_if":     true,
+	"on_conflict": true,
+	"render":      true,
+}
+
+// splitFrontMatter separates a front matter block from the rest of raw. A
+// block starts with a "---" line at the very beginning, ends with the next
+// "---" line and must be a mapping of directive keys only, so documents that
+// merely start with a YAML document marker are left untouched.
+func splitFrontMatter(raw []byte) (*frontMatter, []byte, error) {
+	first, rest, ok := cutLine(raw)
+	if !ok || first != "---" {
+		return nil, raw, nil
+	}
+
+	var block []byte
+	found := false
+	for remaining := rest; len(remaining) > 0; {
+		line, next, _ := cutLine(remaining)
+		if line == "---" {
+			block = rest[:len(rest)-len(remaining)]
+			rest = next
+			found = true
+			break
+		}
+		remaining = next
+	}
+	if !found {
+		return nil, raw, nil
+	}
+
+	var keys map[string]any
+	if err := yaml.Unmarshal(block, &keys); err != nil {
+		// A block that only sets directives was meant as front matter, for
+		// example with an unquoted "{{ }}" value, and is not passed through
+		// as content.
+		if onlyDirectiveLines(block) {
+			return nil, nil, fmt.Errorf("renderfs: parse front matter: %w", err)
+		}
+		return nil, raw, nil
+	}
+	if len(keys) == 0 {
+		return nil, raw, nil
+	}
+	for key := range keys {
+		if !frontMatterKeys[key] {
+			return nil, raw, nil
+		}
+	}
+
+	fm := &frontMatter{}
+	if err := yaml.Unmarshal(block, fm); err != nil {
+		return nil, nil, fmt.Errorf("renderfs: parse front matter: %w", err)
+	}
+	return fm, rest, nil
+}
+
+// onlyDirectiveLines reports whether every top-level line of block, other
+// than blank lines and comments, starts with a front matter key and a colon.
+func onlyDirectiveLines(block []byte) bool {
+	found := false
+	for remaining := block; len(remaining) > 0; {
+		line, next, _ := cutLine(remaining)
+		remaining = next
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		key, _, ok := strings.Cut(line, ":")
+		if !ok || !frontMatterKeys[strings.TrimSpace(key)] {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// cutLine splits the first line, without its line ending, from the rest of
+// data. It reports false when data is empty.
+func cutLine(data []byte) (string, []byte, bool) {
+	if len(data) == 0 {
+		return "", nil, false
+	}
+	line, rest, found := bytes.Cut(data, []byte("\n"))
+	if !found {
+		rest = nil
+	}
+	return strings.TrimSuffix(string(line), "\r"), rest, true
+}
+
+// mode returns the file mode set by the front matter, if any.
+func (fm *frontMatter) mode() (fs.FileMode, bool, error) {
+	// The raw scalar is parsed rather than the decoded value since YAML reads
+	// 644 as a decimal integer.
+	if fm.Mode.Kind == 0 || fm.Mode.Tag == "!!null" {
+		return 0, false, nil
+	}
+	if fm.Mode.Kind != yaml.ScalarNode {
+		return 0, false, fmt.Errorf("renderfs: invalid front matter mode at line %d", fm.Mode.Line)
+	}
+	raw := strings.TrimPrefix(strings.TrimPrefix(fm.Mode.Value, "0o"), "0O")
+	perm, err := strconv.ParseUint(raw, 8, 32)
+	if err != nil || perm > 0o777 {
+		return 0, false, fmt.Errorf("renderfs: invalid front matter mode %q", fm.Mode.Value)
+	}
+	return fs.FileMode(perm), true, nil
+}
+
+// conflict returns the conflict resolution set by the front matter, or def.
+func (fm *frontMatter) conflict(def ConflictResolution) (ConflictResolution, error) {
+	switch strings.ToLower(fm.OnConflict) {
+	case "":
+		return def, nil
+	case "overwrite":
+		return Overwrite, nil
+	case "skip":
+		return Skip, nil
+	case "fail":
+		return Fail, nil
+	default:
+		return def, fmt.Errorf("renderfs: invalid front matter on_conflict %q", fm.OnConflict)
+	}
+}
+
+// evalCondition renders expr as the condition of an if block and reports
+// whether it holds.
+func (r *Renderer) evalCondition(expr string, vars map[string]any) (bool, error) {
+	cfg := r.config()
+	tpl := cfg.BlockStartString + " if " + expr + " " + cfg.BlockEndString + "1" +
+		cfg.BlockStartString + " endif " + cfg.BlockEndString
+	out, err := r.RenderString(tpl, vars)
+	if err != nil {
+		return false, err
+	}
+	return out == "1", nil
+}
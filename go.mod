@@ -3,8 +3,10 @@ module github.com/greyhoundhq/renderfs
 go 1.25.3
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/nikolalohinski/gonja/v2 v2.5.2
 	github.com/sabhiram/go-gitignore v0.0.0-20210923224102-525f6e181f06
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -5,37 +5,85 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"path"
 	"strings"
 
 	ignore "github.com/sabhiram/go-gitignore"
 )
 
-func buildIgnoreMatcher(source fs.FS, patterns []string) (*ignore.GitIgnore, error) {
-	lines := make([]string, 0, len(patterns))
-	for _, pattern := range patterns {
-		pattern = strings.TrimSpace(pattern)
-		if pattern == "" {
-			continue
+// ignoreFileName is the name of the per-directory ignore files. They are
+// rendered as templates and never copied.
+const ignoreFileName = ".renderfs-ignore"
+
+// ignoreMatcher holds the compiled ignore rules of every directory walked so
+// far. Like nested .gitignore files, the patterns of a directory are matched
+// against paths relative to that directory. A path is ignored when the rules
+// of any of its ancestors match it; negations only apply within a single file.
+type ignoreMatcher struct {
+	dirs map[string]*ignore.GitIgnore
+}
+
+func newIgnoreMatcher() *ignoreMatcher {
+	return &ignoreMatcher{dirs: make(map[string]*ignore.GitIgnore)}
+}
+
+// matches reports whether rel, a slash-separated path of the source
+// filesystem, is excluded by the rules of one of its parent directories.
+func (m *ignoreMatcher) matches(rel string) bool {
+	for dir := path.Dir(rel); ; dir = path.Dir(dir) {
+		if rules := m.dirs[dir]; rules != nil {
+			sub := rel
+			if dir != "." {
+				sub = rel[len(dir)+1:]
+			}
+			if rules.MatchesPath(sub) {
+				return true
+			}
+		}
+		if dir == "." {
+			return false
 		}
-		lines = append(lines, pattern)
 	}
+}
 
-	if len(lines) == 0 {
-		raw, err := fs.ReadFile(source, ".renderfs-ignore")
-		if err != nil && !errors.Is(err, fs.ErrNotExist) {
-			return nil, fmt.Errorf("renderfs: read .renderfs-ignore: %w", err)
+// loadIgnoreFile renders the ignore file of dir with vars, if there is one,
+// and records its patterns, replacing those recorded for a previous element
+// of an expanded directory. Options.IgnorePatterns are added to the rules of
+// the root.
+func (p *planner) loadIgnoreFile(dir string, vars map[string]any) error {
+	var lines []string
+	if dir == "." {
+		for _, pattern := range p.opts.IgnorePatterns {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			lines = append(lines, pattern)
 		}
-		if len(raw) > 0 {
-			lines = append(lines, parseIgnoreFile(string(raw))...)
+	}
+
+	name := path.Join(dir, ignoreFileName)
+	raw, err := fs.ReadFile(p.source, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("renderfs: read %s: %w", name, err)
+	}
+	if len(raw) > 0 {
+		rendered, err := p.templatesFor(name).paths.renderTemplate(p.ctx, raw, vars, newSourceLoader(p.roots, dir))
+		if err != nil {
+			if cancelErr := canceled(p.ctx, name); cancelErr != nil {
+				return cancelErr
+			}
+			return &RenderError{Kind: RenderErrorFile, Path: name, Err: err}
 		}
+		lines = append(lines, parseIgnoreFile(string(rendered))...)
 	}
 
 	if len(lines) == 0 {
-		return nil, nil
+		delete(p.ignore.dirs, dir)
+		return nil
 	}
-
-	lines = append(lines, ".renderfs-ignore")
-	return ignore.CompileIgnoreLines(lines...), nil
+	p.ignore.dirs[dir] = ignore.CompileIgnoreLines(lines...)
+	return nil
 }
 
 func parseIgnoreFile(content string) []string {
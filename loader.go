@@ -0,0 +1,195 @@
+package renderfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nikolalohinski/gonja/v2/loaders"
+)
+
+// templateRoots are the filesystems templates may load other templates from.
+type templateRoots struct {
+	source      fs.FS
+	partialsDir string
+	partials    []fs.FS
+}
+
+// sourceLoader implements loaders.Loader on top of the source filesystem and
+// the partial roots so that include, import and extends can never read host
+// files. Identifiers are absolute slash-separated paths: "/docs/header.txt"
+// names a file of the source filesystem and "@1/macros.j2" a file of the
+// second mounted partials filesystem.
+//
+// Relative names resolve against the directory of the template that references
+// them first, then against the partials directory of the source and finally
+// against the root of each mounted partials filesystem in order.
+//
+// Symlinks are followed through fs.ReadLinkFS, as implemented by os.DirFS and
+// os.Root.FS, and rejected when they lead outside their filesystem.
+type sourceLoader struct {
+	roots *templateRoots
+	mount int // -1 for the source filesystem, otherwise an index into roots.partials
+	dir   string
+
+	// prepare, when set, rewrites every template before it is compiled.
+	prepare func(string) string
+}
+
+func newSourceLoader(roots *templateRoots, dir string) *sourceLoader {
+	return &sourceLoader{roots: roots, mount: -1, dir: dir}
+}
+
+func (l *sourceLoader) Resolve(name string) (string, error) {
+	mount, rel, err := l.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	return templateIdentifier(mount, rel), nil
+}
+
+func (l *sourceLoader) resolve(name string) (int, string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+
+	if mount, rel, ok := parseMountIdentifier(name); ok {
+		if mount >= len(l.roots.partials) {
+			return 0, "", fmt.Errorf("renderfs: template %q references an unknown partials filesystem", name)
+		}
+		rel, err := confinePath(name, path.Clean(rel))
+		if err != nil {
+			return 0, "", err
+		}
+		return l.stat(name, mount, rel)
+	}
+
+	if strings.HasPrefix(name, "/") {
+		rel, err := confinePath(name, path.Clean(strings.TrimLeft(name, "/")))
+		if err != nil {
+			return 0, "", err
+		}
+		return l.stat(name, -1, rel)
+	}
+
+	rel, err := confinePath(name, path.Join(l.dir, name))
+	if err != nil {
+		return 0, "", err
+	}
+	if l.exists(l.mount, rel) {
+		return l.mount, rel, nil
+	}
+
+	if rel, err := confinePath(name, path.Clean(name)); err == nil {
+		if l.roots.partialsDir != "" {
+			if candidate := path.Join(l.roots.partialsDir, rel); l.exists(-1, candidate) {
+				return -1, candidate, nil
+			}
+		}
+		for mount := range l.roots.partials {
+			if l.exists(mount, rel) {
+				return mount, rel, nil
+			}
+		}
+	}
+
+	return 0, "", fmt.Errorf("renderfs: template %q not found in source filesystem or partials", name)
+}
+
+func (l *sourceLoader) filesystem(mount int) fs.FS {
+	if mount < 0 {
+		return l.roots.source
+	}
+	return l.roots.partials[mount]
+}
+
+func (l *sourceLoader) exists(mount int, rel string) bool {
+	_, err := fs.Stat(l.filesystem(mount), rel)
+	return err == nil
+}
+
+func (l *sourceLoader) stat(name string, mount int, rel string) (int, string, error) {
+	if _, err := fs.Stat(l.filesystem(mount), rel); err != nil {
+		return 0, "", fmt.Errorf("renderfs: template %q not found: %w", name, err)
+	}
+	return mount, rel, nil
+}
+
+func (l *sourceLoader) Read(name string) (io.Reader, error) {
+	mount, rel, err := l.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	fsys := l.filesystem(mount)
+	target, err := resolveSourcePath(fsys, rel)
+	if err != nil {
+		return nil, fmt.Errorf("renderfs: read template %q: %w", name, err)
+	}
+	data, err := fs.ReadFile(fsys, target)
+	if err != nil {
+		return nil, fmt.Errorf("renderfs: read template %q: %w", name, err)
+	}
+	if l.prepare != nil {
+		return strings.NewReader(l.prepare(string(data))), nil
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (l *sourceLoader) Inherit(from string) (loaders.Loader, error) {
+	if from == "" {
+		return &sourceLoader{roots: l.roots, mount: l.mount, dir: l.dir, prepare: l.prepare}, nil
+	}
+	mount, rel, err := l.resolve(from)
+	if err != nil {
+		return nil, err
+	}
+	return &sourceLoader{roots: l.roots, mount: mount, dir: path.Dir(rel), prepare: l.prepare}, nil
+}
+
+func confinePath(name, clean string) (string, error) {
+	if clean == ".." || strings.HasPrefix(clean, "../") || !fs.ValidPath(clean) {
+		return "", fmt.Errorf("renderfs: template %q escapes the source filesystem", name)
+	}
+	return clean, nil
+}
+
+func templateIdentifier(mount int, rel string) string {
+	if mount < 0 {
+		return "/" + rel
+	}
+	return "@" + strconv.Itoa(mount) + "/" + rel
+}
+
+func parseMountIdentifier(name string) (int, string, bool) {
+	if !strings.HasPrefix(name, "@") {
+		return 0, "", false
+	}
+	index, rel, ok := strings.Cut(name[1:], "/")
+	if !ok {
+		return 0, "", false
+	}
+	mount, err := strconv.Atoi(index)
+	if err != nil || mount < 0 {
+		return 0, "", false
+	}
+	return mount, rel, true
+}
+
+// noSourceLoader is used for templates that are not backed by a source
+// filesystem, such as rendered paths. Every include is rejected.
+type noSourceLoader struct{}
+
+func (noSourceLoader) Resolve(name string) (string, error) {
+	return "", fmt.Errorf("renderfs: cannot load template %q without a source filesystem", name)
+}
+
+func (l noSourceLoader) Read(name string) (io.Reader, error) {
+	_, err := l.Resolve(name)
+	return nil, err
+}
+
+func (l noSourceLoader) Inherit(string) (loaders.Loader, error) {
+	return l, nil
+}
@@ -0,0 +1,119 @@
+package renderfs
+
+import (
+	"path"
+	"regexp"
+
+	ignore "github.com/sabhiram/go-gitignore"
+)
+
+// TemplateOverride selects other template settings for the source entries
+// matching Pattern, a gitignore-style pattern relative to the source root
+// such as ".github/" or "charts/**/templates/*.yaml". Empty delimiters and
+// nil settings keep the value used for the rest of the tree.
+type TemplateOverride struct {
+	Pattern    string
+	Delimiters Delimiters
+
+	TrimBlocks          *bool
+	LeftStripBlocks     *bool
+	TrimTrailingNewline *bool
+	AutoEscape          *bool
+}
+
+// templateSet holds the renderers for the entries sharing a set of template
+// settings.
+type templateSet struct {
+	paths     *Renderer // paths, symlink targets, ignore files and front matter
+	content   *Renderer // file contents, with the file tag
+	expansion *regexp.Regexp
+}
+
+func newTemplateSet(r *Renderer) templateSet {
+	return templateSet{
+		paths:     r,
+		content:   r.withFileTag(),
+		expansion: expansionPattern(r),
+	}
+}
+
+// templateOverride is a compiled TemplateOverride.
+type templateOverride struct {
+	match *ignore.GitIgnore
+	templateSet
+}
+
+func newTemplateOverrides(r *Renderer, overrides []TemplateOverride) []templateOverride {
+	var compiled []templateOverride
+	for _, override := range overrides {
+		match := compilePatterns([]string{override.Pattern})
+		if match == nil {
+			continue
+		}
+		compiled = append(compiled, templateOverride{
+			match:       match,
+			templateSet: newTemplateSet(r.withOverride(override)),
+		})
+	}
+	return compiled
+}
+
+// withOverride returns a copy of r with the settings of o applied.
+func (r *Renderer) withOverride(o TemplateOverride) *Renderer {
+	derived := *r
+	d := o.Delimiters
+	for _, field := range []struct {
+		value  string
+		target *string
+	}{
+		{d.BlockStart, &derived.delimiters.BlockStart},
+		{d.BlockEnd, &derived.delimiters.BlockEnd},
+		{d.VariableStart, &derived.delimiters.VariableStart},
+		{d.VariableEnd, &derived.delimiters.VariableEnd},
+		{d.CommentStart, &derived.delimiters.CommentStart},
+		{d.CommentEnd, &derived.delimiters.CommentEnd},
+	} {
+		if field.value != "" {
+			*field.target = field.value
+		}
+	}
+	for _, field := range []struct {
+		value  *bool
+		target *bool
+	}{
+		{o.TrimBlocks, &derived.whitespace.TrimBlocks},
+		{o.LeftStripBlocks, &derived.whitespace.LeftStripBlocks},
+		{o.TrimTrailingNewline, &derived.whitespace.TrimTrailingNewline},
+		{o.AutoEscape, &derived.autoEscape},
+	} {
+		if field.value != nil {
+			*field.target = *field.value
+		}
+	}
+	return &derived
+}
+
+// templatesFor returns the renderers for the source entry rel. The last
+// matching TemplateOverride wins.
+func (p *planner) templatesFor(rel string) *templateSet {
+	for i := len(p.overrides) - 1; i >= 0; i-- {
+		if p.overrides[i].match.MatchesPath(rel) {
+			return &p.overrides[i].templateSet
+		}
+	}
+	return &p.templates
+}
+
+// overriddenWithin reports whether rel or one of its parents below the scope
+// root uses other template settings than the rest of the tree.
+func (p *planner) overriddenWithin(scope walkScope, rel string) bool {
+	if len(p.overrides) == 0 {
+		return false
+	}
+	for dir := rel; dir != scope.source && dir != "."; dir = path.Dir(dir) {
+		if p.templatesFor(dir) != &p.templates {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,9 @@
 package renderfs
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"path"
 	"strings"
 
@@ -17,11 +19,23 @@ func RenderPath(rel string, isDir bool, ctx map[string]any, strict bool) (string
 // RenderPathWithEnv renders a template path and validates that it stays within destination.
 // It returns the cleaned path, whether it should be skipped, and any error encountered.
 func RenderPathWithEnv(rel string, isDir bool, ctx map[string]any, strict bool, env *exec.Environment) (string, bool, error) {
-	rendered, err := renderTemplateString(rel, ctx, strict, env)
+	return NewRenderer(WithEnvironment(env), WithStrictVariables(strict)).RenderPath(rel, isDir, ctx)
+}
+
+// RenderPath renders a template path and validates that it stays within destination.
+// It returns the cleaned path, whether it should be skipped, and any error encountered.
+func (r *Renderer) RenderPath(rel string, isDir bool, vars map[string]any) (string, bool, error) {
+	rendered, err := r.RenderString(rel, vars)
 	if err != nil {
 		return "", false, err
 	}
+	return normalizeRenderedPath(rendered, isDir, defaultTemplateSuffixes)
+}
 
+// normalizeRenderedPath cleans a rendered path, reports empty results as
+// skipped, rejects paths escaping the destination and strips the first of
+// suffixes that a file name ends with.
+func normalizeRenderedPath(rendered string, isDir bool, suffixes []string) (string, bool, error) {
 	rendered = strings.TrimSpace(rendered)
 	if rendered == "" {
 		return "", true, nil
@@ -33,7 +47,7 @@ func RenderPathWithEnv(rel string, isDir bool, ctx map[string]any, strict bool,
 		return "", true, nil
 	}
 
-	if strings.HasPrefix(clean, "../") || strings.HasPrefix(clean, "/") {
+	if clean == ".." || strings.HasPrefix(clean, "../") || strings.HasPrefix(clean, "/") {
 		return "", false, fmt.Errorf("renderfs: rendered path %q escapes destination", rendered)
 	}
 	if isWindowsAbs(clean) {
@@ -42,7 +56,7 @@ func RenderPathWithEnv(rel string, isDir bool, ctx map[string]any, strict bool,
 
 	if !isDir {
 		base := path.Base(clean)
-		stripped := stripTemplateSuffix(base)
+		stripped := stripTemplateSuffix(base, suffixes)
 		if stripped == "" || stripped == "." {
 			return "", true, nil
 		}
@@ -52,6 +66,83 @@ func RenderPathWithEnv(rel string, isDir bool, ctx map[string]any, strict bool,
 	return clean, false, nil
 }
 
+// renderSymlinkTarget renders the target of the symlink at link, a rendered
+// destination path. When confine is set, targets that are absolute or resolve
+// outside the destination root are rejected.
+func (r *Renderer) renderSymlinkTarget(link, target string, vars map[string]any, confine bool) (string, error) {
+	rendered, err := r.RenderString(target, vars)
+	if err != nil {
+		return "", err
+	}
+	rendered = strings.TrimSpace(rendered)
+	if rendered == "" {
+		return "", fmt.Errorf("renderfs: symlink target %q renders empty", target)
+	}
+	if !confine {
+		return rendered, nil
+	}
+
+	slashed := strings.ReplaceAll(rendered, "\\", "/")
+	if strings.HasPrefix(slashed, "/") || isWindowsAbs(slashed) {
+		return "", fmt.Errorf("renderfs: symlink target %q is absolute", rendered)
+	}
+	resolved := path.Join(path.Dir(link), slashed)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return "", fmt.Errorf("renderfs: symlink target %q escapes destination", rendered)
+	}
+	return rendered, nil
+}
+
+// resolveSourcePath follows the symlinks in name, a valid path of fsys, and
+// returns the path they lead to. Links whose target is absolute or resolves
+// outside fsys are rejected, as are chains longer than maxSymlinkDepth.
+// Components that do not exist end the resolution. Filesystems that do not
+// implement fs.ReadLinkFS are trusted as they are.
+func resolveSourcePath(fsys fs.FS, name string) (string, error) {
+	links, ok := fsys.(fs.ReadLinkFS)
+	if !ok {
+		return name, nil
+	}
+
+	resolved := "."
+	pending := strings.Split(name, "/")
+	for followed := 0; len(pending) > 0; {
+		next := path.Join(resolved, pending[0])
+		pending = pending[1:]
+
+		info, err := links.Lstat(next)
+		if errors.Is(err, fs.ErrNotExist) {
+			return path.Join(append([]string{next}, pending...)...), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if followed++; followed > maxSymlinkDepth {
+			return "", fmt.Errorf("renderfs: too many levels of symlinks at %s", name)
+		}
+		target, err := links.ReadLink(next)
+		if err != nil {
+			return "", err
+		}
+		target = strings.ReplaceAll(target, "\\", "/")
+		if strings.HasPrefix(target, "/") || isWindowsAbs(target) {
+			return "", fmt.Errorf("renderfs: symlink %s points to absolute path %q outside the source filesystem", next, target)
+		}
+		joined := path.Join(resolved, target)
+		if joined == ".." || strings.HasPrefix(joined, "../") {
+			return "", fmt.Errorf("renderfs: symlink %s escapes the source filesystem", next)
+		}
+		pending = append(strings.Split(joined, "/"), pending...)
+		resolved = "."
+	}
+	return resolved, nil
+}
+
 func isWindowsAbs(value string) bool {
 	if strings.HasPrefix(value, "//") {
 		return true
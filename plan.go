@@ -0,0 +1,948 @@
+package renderfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	ignore "github.com/sabhiram/go-gitignore"
+)
+
+// OperationKind identifies the action an Operation performs on the destination.
+type OperationKind string
+
+const (
+	OpMkdir     OperationKind = "mkdir"
+	OpCreate    OperationKind = "create"
+	OpUpdate    OperationKind = "update"
+	OpSkip      OperationKind = "skip"
+	OpIdentical OperationKind = "identical"
+	OpSymlink   OperationKind = "symlink"
+)
+
+// Operation describes a single change to the destination computed by Plan.
+type Operation struct {
+	Kind OperationKind
+
+	// Source is the path of the entry in the source filesystem.
+	Source string
+
+	// Path is the rendered path relative to the destination root.
+	Path string
+
+	// Mode holds the permission bits used for directories and files.
+	Mode fs.FileMode
+
+	// Data holds the rendered file content. It is nil for directories,
+	// symlinks and verbatim files.
+	Data []byte
+
+	// Verbatim reports that the file is copied byte for byte. Its content is
+	// streamed from Source when the plan is applied instead of being held in
+	// Data.
+	Verbatim bool
+
+	// Size is the number of bytes written for file operations.
+	Size int64
+
+	// Target is the link target of symlink operations.
+	Target string
+
+	// Replace reports that the existing destination entry, a symlink for file
+	// operations or any file or link for symlink operations, is removed
+	// before writing. Apply requires a RemoveWriter for such operations.
+	Replace bool
+
+	// Dependencies lists, in lexical order, the source paths the template
+	// looked at through read_file, exists, file_hash and glob, including
+	// the patterns passed to glob. A change to any of them can change Data.
+	Dependencies []string
+}
+
+// ChangePlan is the ordered list of operations needed to render a source
+// filesystem into a destination. It is produced by Plan and executed by Apply.
+type ChangePlan struct {
+	Operations []Operation
+
+	// source provides the content of verbatim operations.
+	source fs.FS
+
+	// transactional makes Apply roll back every change when it fails.
+	transactional bool
+}
+
+// open returns the content written by a create or update operation.
+func (p *ChangePlan) open(op Operation) (io.ReadCloser, error) {
+	if !op.Verbatim {
+		return io.NopCloser(bytes.NewReader(op.Data)), nil
+	}
+	if p.source == nil {
+		return nil, fmt.Errorf("renderfs: plan has no source filesystem for %s", op.Source)
+	}
+	f, err := p.source.Open(op.Source)
+	if err != nil {
+		return nil, fmt.Errorf("renderfs: read %s: %w", op.Source, err)
+	}
+	return f, nil
+}
+
+// Stats returns the statistics Apply reports when the plan executes successfully.
+func (p *ChangePlan) Stats() Stats {
+	var stats Stats
+	if p == nil {
+		return stats
+	}
+	for _, op := range p.Operations {
+		stats.count(op)
+	}
+	return stats
+}
+
+// count adds op to the statistics. Symlinks count as created, or as updated
+// when they replace an existing entry.
+func (s *Stats) count(op Operation) {
+	switch op.Kind {
+	case OpSymlink:
+		if op.Replace {
+			s.Updated++
+		} else {
+			s.Created++
+		}
+	case OpCreate:
+		s.Created++
+	case OpUpdate:
+		s.Updated++
+	case OpSkip:
+		s.Skipped++
+	case OpIdentical:
+		s.Identical++
+	}
+}
+
+// Plan walks the source filesystem and renders every path and template into
+// a ChangePlan without modifying the destination. Existing files are read
+// through dest to classify each operation; when dest is nil every file is
+// planned as a create. Rendering errors and conflicts are reported before
+// anything is written.
+func Plan(source fs.FS, dest Writer, opts Options) (*ChangePlan, error) {
+	return PlanContext(context.Background(), source, dest, opts)
+}
+
+// PlanContext is like Plan but stops with a RenderErrorCanceled error wrapping
+// ctx.Err() as soon as ctx is done, including while a template is rendering.
+func PlanContext(ctx context.Context, source fs.FS, dest Writer, opts Options) (*ChangePlan, error) {
+	if source == nil {
+		return nil, fmt.Errorf("renderfs: source filesystem is required")
+	}
+
+	vars := opts.Context
+	if vars == nil {
+		vars = map[string]any{}
+	}
+	renderer := opts.renderer()
+
+	conflict := opts.OnConflict
+	if conflict < Overwrite || conflict > Fail {
+		conflict = Overwrite
+	}
+
+	roots := &templateRoots{source: source, partials: opts.Partials}
+	if opts.PartialsDir != "" {
+		roots.partialsDir = path.Clean(strings.Trim(strings.ReplaceAll(opts.PartialsDir, "\\", "/"), "/"))
+		if !fs.ValidPath(roots.partialsDir) || roots.partialsDir == "." {
+			return nil, fmt.Errorf("renderfs: invalid partials directory %q", opts.PartialsDir)
+		}
+	}
+
+	cfg, err := loadSourceConfig(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &planner{
+		ctx:       ctx,
+		source:    source,
+		dest:      dest,
+		opts:      opts,
+		conflict:  conflict,
+		roots:     roots,
+		renderer:  renderer,
+		ignore:    newIgnoreMatcher(),
+		outputs:   make(map[string]output),
+		templates: newTemplateSet(renderer),
+		overrides: newTemplateOverrides(renderer, opts.TemplateOverrides),
+		suffixes:  opts.templateSuffixes(),
+		verbatim:  compilePatterns(opts.CopyWithoutRender, cfg.CopyWithoutRender),
+	}
+
+	walkErr := fs.WalkDir(source, ".", p.visitor(walkScope{source: ".", dest: ".", vars: vars}))
+
+	// Files before the entry that stopped the walk still have to render so
+	// that the error of the lexically first failing path is reported.
+	errs := make([]error, len(p.ops)+1)
+	errs[len(p.ops)] = walkErr
+	p.results = make([]fileResult, len(p.ops))
+	p.renderFiles(p.ops, p.pending, errs)
+	if failed := slices.IndexFunc(errs, func(err error) bool { return err != nil }); failed >= 0 {
+		// The entries before the failure may still collide or conflict.
+		if _, err := p.finishFiles(failed); err != nil {
+			return nil, err
+		}
+		return nil, errs[failed]
+	}
+
+	ops, err := p.finishFiles(len(p.ops))
+	if err != nil {
+		return nil, err
+	}
+	return &ChangePlan{Operations: ops, source: source, transactional: opts.Transactional}, nil
+}
+
+// finishFiles applies what rendering decided about the first limit
+// operations, claiming the destination paths of files, which are only known
+// once front matter and the file tag have been evaluated, and classifying
+// them against the destination one at a time in walk order: files skipped by
+// their front matter are dropped, files given another output path are moved,
+// and files whose template used the file tag are replaced by one operation
+// per emitted file. Emitted paths are relative to the directory of the
+// generating file; both kinds of paths are validated like rendered paths.
+func (p *planner) finishFiles(limit int) ([]Operation, error) {
+	isFile := make([]bool, len(p.ops))
+	for _, file := range p.pending {
+		isFile[file.index] = true
+	}
+
+	ops := make([]Operation, 0, limit)
+	for i, op := range p.ops[:limit] {
+		if !isFile[i] {
+			ops = append(ops, op)
+			continue
+		}
+		if err := canceled(p.ctx, op.Source); err != nil {
+			return nil, err
+		}
+		result := p.results[i]
+		if result.skip {
+			continue
+		}
+		if result.output != "" {
+			op.Path = result.output
+		}
+		if result.emitted == nil {
+			if err := p.claim(op.Source, op.Path, false); err != nil {
+				return nil, err
+			}
+			if err := p.classify(&op, result.conflict, func() (io.ReadCloser, error) {
+				if op.Verbatim {
+					return p.source.Open(op.Source)
+				}
+				return io.NopCloser(bytes.NewReader(op.Data)), nil
+			}); err != nil {
+				return nil, err
+			}
+			ops = append(ops, op)
+			continue
+		}
+
+		for _, file := range result.emitted {
+			rel, skip, err := normalizeRenderedPath(path.Join(path.Dir(op.Path), file.path), false, p.suffixes)
+			if err != nil {
+				return nil, &RenderError{Kind: RenderErrorFile, Path: op.Source, Err: err}
+			}
+			if skip {
+				continue
+			}
+			if err := p.claim(op.Source, rel, false); err != nil {
+				return nil, err
+			}
+
+			emitted := Operation{
+				Source:       op.Source,
+				Path:         rel,
+				Mode:         op.Mode,
+				Data:         file.data,
+				Size:         int64(len(file.data)),
+				Dependencies: op.Dependencies,
+			}
+			if err := p.classify(&emitted, result.conflict, func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(file.data)), nil
+			}); err != nil {
+				return nil, err
+			}
+			ops = append(ops, emitted)
+		}
+	}
+	return ops, nil
+}
+
+// walkScope is the part of the source tree a visitor walks. Entries below an
+// expanded directory render their paths relative to it, with the loop
+// variable in vars, and are placed under the directory rendered for the
+// current element.
+type walkScope struct {
+	source string // source directory the scope starts at, "." for the root
+	dest   string // rendered destination path of source, "." for the root
+	vars   map[string]any
+}
+
+// visitor returns the fs.WalkDirFunc planning every entry of scope.
+func (p *planner) visitor(scope walkScope) fs.WalkDirFunc {
+	var visit fs.WalkDirFunc
+	visit = func(rel string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if err := canceled(p.ctx, rel); err != nil {
+			return err
+		}
+		if rel == scope.source {
+			// Expanded directories are planned by the scope expanding them.
+			if rel == "." {
+				return p.loadIgnoreFile(rel, scope.vars)
+			}
+			return nil
+		}
+
+		if p.ignore.matches(rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if rel == p.roots.partialsDir {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if path.Base(rel) == ignoreFileName || rel == configFileName {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("renderfs: stat %s: %w", rel, err)
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 && p.opts.DereferenceSymlinks {
+			if !p.opts.DereferenceExternalSymlinks {
+				if _, err := resolveSourcePath(p.source, rel); err != nil {
+					return &RenderError{Kind: RenderErrorPath, Path: rel, Err: err}
+				}
+			}
+			followed, err := fs.Stat(p.source, rel)
+			if err != nil {
+				return fmt.Errorf("renderfs: follow symlink %s: %w", rel, err)
+			}
+			if followed.IsDir() {
+				if p.derefDepth >= maxSymlinkDepth {
+					return fmt.Errorf("renderfs: too many levels of symlinks at %s", rel)
+				}
+				// Walking the link as a root reports it as a directory and
+				// descends into the directory it points to.
+				p.derefDepth++
+				err := fs.WalkDir(p.source, rel, visit)
+				p.derefDepth--
+				return err
+			}
+			info = followed
+		}
+
+		if spec, ok := p.parseExpansion(rel); ok {
+			return p.expand(scope, rel, info, spec)
+		}
+
+		renderedRel, skip, err := p.renderRel(scope, rel, info.IsDir())
+		if err != nil {
+			return &RenderError{Kind: RenderErrorPath, Path: rel, Err: err}
+		}
+		if skip {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target, err := readSymlink(p.source, rel)
+			if err != nil {
+				return fmt.Errorf("renderfs: read symlink %s: %w", rel, err)
+			}
+			target, err = p.templatesFor(rel).paths.renderSymlinkTarget(renderedRel, target, scope.vars, p.opts.ConfineSymlinks)
+			if err != nil {
+				return &RenderError{Kind: RenderErrorPath, Path: rel, Err: err}
+			}
+			op := Operation{
+				Kind:   OpSymlink,
+				Source: rel,
+				Path:   renderedRel,
+				Target: target,
+			}
+			if err := p.claim(rel, renderedRel, false); err != nil {
+				return err
+			}
+			if err := p.classifySymlink(&op); err != nil {
+				return err
+			}
+			p.ops = append(p.ops, op)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		return p.addEntry(rel, renderedRel, info, scope.vars)
+	}
+	return visit
+}
+
+// renderRel renders the path of rel relative to the directory scope starts
+// at and places it under the destination path of that directory. When rel or
+// one of its parents uses other template settings, each name is rendered on
+// its own with the settings of the entry it names.
+func (p *planner) renderRel(scope walkScope, rel string, isDir bool) (string, bool, error) {
+	if !p.overriddenWithin(scope, rel) {
+		sub := rel
+		if scope.source != "." {
+			sub = strings.TrimPrefix(rel, scope.source+"/")
+		}
+		name, err := p.renderer.RenderString(sub, scope.vars)
+		if err != nil {
+			return "", false, err
+		}
+		rendered, skip, err := normalizeRenderedPath(name, isDir, p.suffixes)
+		if err != nil || skip {
+			return "", skip, err
+		}
+		return path.Join(scope.dest, rendered), false, nil
+	}
+
+	parent := scope.dest
+	if dir := path.Dir(rel); dir != scope.source {
+		rendered, skip, err := p.renderRel(scope, dir, true)
+		if err != nil || skip {
+			return "", skip, err
+		}
+		parent = rendered
+	}
+	name, err := p.templatesFor(rel).paths.RenderString(path.Base(rel), scope.vars)
+	if err != nil {
+		return "", false, err
+	}
+	elem, skip, err := normalizeRenderedPath(name, isDir, p.suffixes)
+	if err != nil || skip {
+		return "", skip, err
+	}
+	return path.Join(parent, elem), false, nil
+}
+
+// addEntry plans the directory or file rel rendered to renderedRel. Directory
+// ignore files are loaded with vars, and file contents are rendered with vars
+// once the walk is over; files claim their path in finishFiles.
+func (p *planner) addEntry(rel, renderedRel string, info fs.FileInfo, vars map[string]any) error {
+	if info.IsDir() {
+		if err := p.claim(rel, renderedRel, true); err != nil {
+			return err
+		}
+		p.ops = append(p.ops, Operation{
+			Kind:   OpMkdir,
+			Source: rel,
+			Path:   renderedRel,
+			Mode:   directoryMode(info),
+		})
+		return p.loadIgnoreFile(rel, vars)
+	}
+
+	p.pending = append(p.pending, pendingFile{index: len(p.ops), vars: vars})
+	p.ops = append(p.ops, Operation{
+		Source: rel,
+		Path:   renderedRel,
+		Mode:   fileMode(info),
+		Size:   info.Size(),
+	})
+	return nil
+}
+
+// maxSymlinkDepth is the number of nested symlinked directories followed
+// under Options.DereferenceSymlinks before Plan gives up.
+const maxSymlinkDepth = 40
+
+// planner holds the state shared by the workers rendering file contents.
+type planner struct {
+	ctx       context.Context
+	source    fs.FS
+	dest      Writer
+	opts      Options
+	conflict  ConflictResolution
+	roots     *templateRoots
+	renderer  *Renderer
+	ignore    *ignoreMatcher
+	outputs   map[string]output
+	templates templateSet
+	overrides []templateOverride
+	suffixes  []string
+	verbatim  *ignore.GitIgnore
+
+	// The walk appends to ops and pending; derefDepth counts the symlinked
+	// directories being walked into, to stop on cycles when
+	// Options.DereferenceSymlinks is set.
+	ops        []Operation
+	pending    []pendingFile
+	derefDepth int
+
+	// results holds, per operation index, what rendering decided about
+	// files that finishFiles has to apply.
+	results []fileResult
+}
+
+// fileResult records the effects of rendering a file that can only be
+// applied once every file has rendered, since they claim destination paths.
+type fileResult struct {
+	skip     bool               // front matter skip_if held
+	output   string             // destination path set by front matter
+	emitted  []emittedFile      // files written with the file tag
+	conflict ConflictResolution // resolution for moved and emitted files
+}
+
+// pendingFile is a file operation whose content still has to be rendered
+// with vars.
+type pendingFile struct {
+	index int
+	vars  map[string]any
+}
+
+// output records the source entry that produced a destination path.
+type output struct {
+	source string
+	isDir  bool
+}
+
+// claim records that source renders to rendered and fails with a
+// RenderErrorCollision error when another entry already did. Directories may
+// share a path since their contents merge without overwriting each other.
+func (p *planner) claim(source, rendered string, isDir bool) error {
+	key := rendered
+	if p.opts.CaseInsensitiveCollisions {
+		key = strings.ToLower(rendered)
+	}
+	if prev, ok := p.outputs[key]; ok && !(prev.isDir && isDir) {
+		return &RenderError{
+			Kind:  RenderErrorCollision,
+			Path:  source,
+			Other: prev.source,
+			Err:   fmt.Errorf("both render to %q", rendered),
+		}
+	}
+	p.outputs[key] = output{source: source, isDir: isDir}
+	return nil
+}
+
+// renderFiles renders the file operations at the pending indices, using up to
+// Options.Concurrency workers, and stores each failure at its index in errs.
+// Files after the first known failure are skipped since their errors could
+// never be reported.
+func (p *planner) renderFiles(ops []Operation, pending []pendingFile, errs []error) {
+	workers := min(max(p.opts.Concurrency, 1), len(pending))
+
+	var firstFailed atomic.Int64
+	firstFailed.Store(int64(len(errs)))
+	for i, err := range errs {
+		if err != nil {
+			firstFailed.Store(int64(i))
+			break
+		}
+	}
+
+	files := make(chan pendingFile)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for file := range files {
+				i := file.index
+				if int64(i) > firstFailed.Load() {
+					continue
+				}
+				if err := p.renderFile(i, &ops[i], file.vars); err != nil {
+					errs[i] = err
+					for {
+						current := firstFailed.Load()
+						if int64(i) >= current || firstFailed.CompareAndSwap(current, int64(i)) {
+							break
+						}
+					}
+				}
+			}
+		})
+	}
+	for _, file := range pending {
+		files <- file
+	}
+	close(files)
+	wg.Wait()
+}
+
+// renderFile renders the content of the file operation at index with vars.
+// Front matter directives are applied first. When the template uses the file
+// tag, its own output is discarded and the emitted files are recorded
+// instead. The destination is left alone: workers run concurrently, so
+// finishFiles classifies the results.
+func (p *planner) renderFile(index int, op *Operation, vars map[string]any) error {
+	rel := op.Source
+	if err := canceled(p.ctx, rel); err != nil {
+		return err
+	}
+
+	f, err := p.source.Open(rel)
+	if err != nil {
+		return fmt.Errorf("renderfs: read %s: %w", rel, err)
+	}
+	defer f.Close()
+
+	// Binary files are detected from their first bytes and streamed
+	// verbatim, so they are never held in memory. So are files that are not
+	// templates, see isTemplate.
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("renderfs: read %s: %w", rel, err)
+	}
+	head = head[:n]
+
+	verbatim := !p.isTemplate(rel) || (!p.renderer.templateBinary && isBinary(head))
+	if verbatim {
+		op.Verbatim = true
+		p.results[index] = fileResult{conflict: p.conflict}
+		return nil
+	}
+
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("renderfs: read %s: %w", rel, err)
+	}
+	rawContent := append(head, rest...)
+
+	fm, rawContent, err := splitFrontMatter(rawContent)
+	if err != nil {
+		return &RenderError{Kind: RenderErrorFile, Path: rel, Err: err}
+	}
+	result := fileResult{conflict: p.conflict}
+	render := true
+	if fm != nil {
+		if err := p.applyFrontMatter(fm, op, vars, &result); err != nil {
+			return &RenderError{Kind: RenderErrorFile, Path: rel, Err: err}
+		}
+		if fm.Render != nil {
+			render = *fm.Render
+		}
+	}
+	if result.skip {
+		p.results[index] = result
+		return nil
+	}
+
+	finalBytes := rawContent
+	if render {
+		collector := &fileCollector{}
+		functions := newSourceFunctions(p.source, path.Dir(rel))
+		vars = maps.Clone(vars)
+		vars[fileCollectorKey] = collector
+		functions.addTo(vars)
+
+		loader := newSourceLoader(p.roots, path.Dir(rel))
+		finalBytes, err = p.templatesFor(rel).content.renderTemplate(p.ctx, rawContent, vars, loader)
+		if err != nil {
+			if cancelErr := canceled(p.ctx, rel); cancelErr != nil {
+				return cancelErr
+			}
+			return &RenderError{Kind: RenderErrorFile, Path: rel, Err: err}
+		}
+		if len(collector.files) > 0 {
+			result.emitted = collector.files
+		}
+		op.Dependencies = functions.dependencies()
+	}
+
+	op.Data = finalBytes
+	op.Size = int64(len(finalBytes))
+	p.results[index] = result
+	return nil
+}
+
+// isTemplate reports whether the content of the source file rel is rendered.
+// Files matching a CopyWithoutRender pattern never are. With
+// Options.TemplateSuffixOnly, only names ending with a template suffix are;
+// the name of an expanded file is the body of its loop.
+func (p *planner) isTemplate(rel string) bool {
+	if p.verbatim != nil && p.verbatim.MatchesPath(rel) {
+		return false
+	}
+	if !p.opts.TemplateSuffixOnly {
+		return true
+	}
+	name := path.Base(rel)
+	if spec, ok := p.parseExpansion(rel); ok {
+		name = spec.body
+	}
+	return templateSuffix(name, p.suffixes) != ""
+}
+
+// applyFrontMatter evaluates the directives of fm for op, setting its mode
+// and recording the skip condition, output path and conflict resolution in
+// result.
+func (p *planner) applyFrontMatter(fm *frontMatter, op *Operation, vars map[string]any, result *fileResult) error {
+	if fm.SkipIf != "" {
+		skip, err := p.templatesFor(op.Source).paths.evalCondition(fm.SkipIf, vars)
+		if err != nil {
+			return fmt.Errorf("renderfs: evaluate skip_if: %w", err)
+		}
+		if skip {
+			result.skip = true
+			return nil
+		}
+	}
+
+	if mode, ok, err := fm.mode(); err != nil {
+		return err
+	} else if ok {
+		op.Mode = mode
+	}
+
+	conflict, err := fm.conflict(p.conflict)
+	if err != nil {
+		return err
+	}
+	result.conflict = conflict
+
+	if fm.Output != "" {
+		name, err := p.templatesFor(op.Source).paths.RenderString(fm.Output, vars)
+		if err != nil {
+			return fmt.Errorf("renderfs: render output: %w", err)
+		}
+		output, skip, err := normalizeRenderedPath(path.Join(path.Dir(op.Path), name), false, p.suffixes)
+		if err != nil {
+			return err
+		}
+		if skip {
+			result.skip = true
+			return nil
+		}
+		result.output = output
+	}
+	return nil
+}
+
+// classify sets the kind of a file operation by comparing its content, read
+// through open, with the destination, resolving conflicts with conflict.
+func (p *planner) classify(op *Operation, conflict ConflictResolution, open func() (io.ReadCloser, error)) error {
+	op.Kind = OpCreate
+	if p.dest == nil {
+		return nil
+	}
+
+	kind, replace, err := checkDestination(p.dest, op.Path, op.Size, open, conflict, p.opts.OnSymlink)
+	if err != nil {
+		return err
+	}
+	op.Kind = kind
+	op.Replace = replace
+	return nil
+}
+
+// classifySymlink compares a symlink operation with the destination entry at
+// its path. A link with the same target is identical; anything else is a
+// conflict resolved by OnConflict.
+func (p *planner) classifySymlink(op *Operation) error {
+	lw, ok := p.dest.(LstatWriter)
+	if !ok {
+		return nil
+	}
+	info, err := lw.Lstat(op.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("renderfs: check destination %s: %w", op.Path, err)
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if rw, ok := p.dest.(ReadLinkWriter); ok {
+			target, err := rw.ReadLink(op.Path)
+			if err != nil {
+				return fmt.Errorf("renderfs: read symlink %s: %w", op.Path, err)
+			}
+			if target == op.Target {
+				op.Kind = OpIdentical
+				return nil
+			}
+		}
+	}
+
+	kind, err := resolveConflict(op.Path, p.conflict)
+	if err != nil {
+		return err
+	}
+	if kind != OpUpdate {
+		op.Kind = kind
+		return nil
+	}
+	if info.IsDir() {
+		return fmt.Errorf("renderfs: cannot replace directory %s with a symlink", op.Path)
+	}
+	op.Replace = true
+	return nil
+}
+
+// Apply executes the operations of a plan against dest in order. It returns
+// statistics for the operations completed so far, even when an error occurs,
+// unless the plan was made with Options.Transactional, in which case a failed
+// Apply is rolled back.
+func Apply(plan *ChangePlan, dest Writer) (Stats, error) {
+	return ApplyContext(context.Background(), plan, dest)
+}
+
+// ApplyContext is like Apply but stops with a RenderErrorCanceled error
+// wrapping ctx.Err() as soon as ctx is done, including between chunks of a
+// file being written.
+func ApplyContext(ctx context.Context, plan *ChangePlan, dest Writer) (Stats, error) {
+	var stats Stats
+
+	if plan == nil {
+		return stats, fmt.Errorf("renderfs: plan is required")
+	}
+	if dest == nil {
+		return stats, fmt.Errorf("renderfs: destination writer is required")
+	}
+
+	if plan.transactional {
+		tx, err := NewTransaction(dest)
+		if err != nil {
+			return stats, err
+		}
+		stats, err = applyOperations(ctx, plan, tx)
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				return Stats{}, errors.Join(err, rollbackErr)
+			}
+			return Stats{}, err
+		}
+		return stats, tx.Commit()
+	}
+
+	return applyOperations(ctx, plan, dest)
+}
+
+func applyOperations(ctx context.Context, plan *ChangePlan, dest Writer) (Stats, error) {
+	var stats Stats
+	for _, op := range plan.Operations {
+		if err := canceled(ctx, op.Path); err != nil {
+			return stats, err
+		}
+		if err := applyOperation(ctx, plan, dest, op); err != nil {
+			if cancelErr := canceled(ctx, op.Path); cancelErr != nil {
+				return stats, cancelErr
+			}
+			return stats, err
+		}
+		stats.count(op)
+	}
+
+	return stats, nil
+}
+
+func applyOperation(ctx context.Context, plan *ChangePlan, dest Writer, op Operation) error {
+	switch op.Kind {
+	case OpMkdir:
+		return dest.MkdirAll(op.Path, op.Mode)
+	case OpSymlink:
+		if err := removeReplaced(dest, op); err != nil {
+			return err
+		}
+		if err := dest.Symlink(op.Target, op.Path); err != nil {
+			return fmt.Errorf("renderfs: create symlink %s -> %s: %w", op.Path, op.Target, err)
+		}
+		return nil
+	case OpCreate, OpUpdate:
+		content, err := plan.open(op)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		if err := removeReplaced(dest, op); err != nil {
+			return err
+		}
+		return writeFile(ctx, dest, op.Path, op.Mode, content)
+	case OpSkip, OpIdentical:
+		return nil
+	default:
+		return fmt.Errorf("renderfs: unknown operation %q for %s", op.Kind, op.Path)
+	}
+}
+
+// removeReplaced removes the destination entry of an operation marked
+// Replace.
+func removeReplaced(dest Writer, op Operation) error {
+	if !op.Replace {
+		return nil
+	}
+	remover, ok := dest.(RemoveWriter)
+	if !ok {
+		return fmt.Errorf("renderfs: cannot replace %s: destination does not implement RemoveWriter", op.Path)
+	}
+	if err := remover.Remove(op.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("renderfs: remove %s: %w", op.Path, err)
+	}
+	return nil
+}
+
+// writeFile streams content to renderedRel, checking ctx between chunks.
+func writeFile(ctx context.Context, dest Writer, renderedRel string, mode fs.FileMode, content io.Reader) error {
+	if parent := path.Dir(renderedRel); parent != "." {
+		if err := dest.MkdirAll(parent, 0o755); err != nil {
+			return fmt.Errorf("renderfs: create parent %s: %w", parent, err)
+		}
+	}
+
+	handle, err := dest.CreateFile(renderedRel, mode)
+	if err != nil {
+		return fmt.Errorf("renderfs: create %s: %w", renderedRel, err)
+	}
+
+	// Hiding any WriterTo implementation keeps io.Copy writing in bounded
+	// chunks so cancellation is observed mid-file.
+	_, writeErr := io.Copy(contextWriter{ctx: ctx, w: handle}, struct{ io.Reader }{content})
+	if writeErr != nil {
+		if aborter, ok := handle.(Aborter); ok {
+			_ = aborter.Abort()
+		} else {
+			_ = handle.Close()
+		}
+		return fmt.Errorf("renderfs: write %s: %w", renderedRel, writeErr)
+	}
+	if closeErr := handle.Close(); closeErr != nil {
+		return fmt.Errorf("renderfs: close %s: %w", renderedRel, closeErr)
+	}
+
+	return nil
+}
+
+// canceled returns a RenderErrorCanceled error for rel when ctx is done.
+func canceled(ctx context.Context, rel string) error {
+	if err := ctx.Err(); err != nil {
+		return &RenderError{Kind: RenderErrorCanceled, Path: rel, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package renderfs
+
+import (
+	"context"
+	"io/fs"
+
+	"github.com/nikolalohinski/gonja/v2"
+	"github.com/nikolalohinski/gonja/v2/exec"
+
+	"github.com/greyhoundhq/renderfs/filters"
+)
+
+// Renderer renders template strings, file contents and paths with a fixed
+// configuration. A Renderer is immutable once constructed and safe for
+// concurrent use.
+type Renderer struct {
+	env            *exec.Environment
+	strict         bool
+	templateBinary bool
+	cache          *TemplateCache
+	delimiters     Delimiters
+	whitespace     Whitespace
+	autoEscape     bool
+}
+
+// Delimiters overrides the markers Gonja uses to recognize blocks, variables
+// and comments. Empty fields keep the defaults ({% %}, {{ }} and {# #}).
+type Delimiters struct {
+	BlockStart    string
+	BlockEnd      string
+	VariableStart string
+	VariableEnd   string
+	CommentStart  string
+	CommentEnd    string
+}
+
+// Whitespace controls how template markup affects the whitespace around it.
+// The zero value keeps every character outside of tags.
+type Whitespace struct {
+	// TrimBlocks removes the first newline after a block tag.
+	TrimBlocks bool
+
+	// LeftStripBlocks strips spaces and tabs from the start of a line up to
+	// a block tag.
+	LeftStripBlocks bool
+
+	// TrimTrailingNewline removes a single newline at the end of the
+	// output. Gonja keeps it by default, unlike Jinja.
+	TrimTrailingNewline bool
+}
+
+// RendererOption configures a Renderer.
+type RendererOption func(*rendererConfig)
+
+type rendererConfig struct {
+	env            *exec.Environment
+	strict         bool
+	templateBinary bool
+	cache          *TemplateCache
+	filters        map[string]exec.FilterFunction
+	delimiters     Delimiters
+	whitespace     Whitespace
+	autoEscape     bool
+}
+
+// WithEnvironment sets the Gonja environment. When nil or not set,
+// gonja.DefaultEnvironment is used.
+func WithEnvironment(env *exec.Environment) RendererOption {
+	return func(c *rendererConfig) {
+		c.env = env
+	}
+}
+
+// WithStrictVariables causes rendering to fail if a template references an
+// undefined variable.
+func WithStrictVariables(strict bool) RendererOption {
+	return func(c *rendererConfig) {
+		c.strict = strict
+	}
+}
+
+// WithTemplateBinary renders binary content as templates. By default binary
+// content is returned unchanged.
+func WithTemplateBinary(templateBinary bool) RendererOption {
+	return func(c *rendererConfig) {
+		c.templateBinary = templateBinary
+	}
+}
+
+// WithTemplateCache sets the cache used for compiled templates. When nil or
+// not set, a bounded package-level cache is used.
+func WithTemplateCache(cache *TemplateCache) RendererOption {
+	return func(c *rendererConfig) {
+		c.cache = cache
+	}
+}
+
+// WithFilters adds filters on top of the environment's filter set, replacing
+// filters of the same name. The environment itself is not modified.
+func WithFilters(filters map[string]exec.FilterFunction) RendererOption {
+	return func(c *rendererConfig) {
+		if c.filters == nil {
+			c.filters = make(map[string]exec.FilterFunction, len(filters))
+		}
+		for name, fn := range filters {
+			c.filters[name] = fn
+		}
+	}
+}
+
+// WithDelimiters overrides the template delimiters.
+func WithDelimiters(delimiters Delimiters) RendererOption {
+	return func(c *rendererConfig) {
+		c.delimiters = delimiters
+	}
+}
+
+// WithWhitespace sets the whitespace controls.
+func WithWhitespace(whitespace Whitespace) RendererOption {
+	return func(c *rendererConfig) {
+		c.whitespace = whitespace
+	}
+}
+
+// WithAutoEscape enables HTML escaping of every printed value.
+func WithAutoEscape(autoEscape bool) RendererOption {
+	return func(c *rendererConfig) {
+		c.autoEscape = autoEscape
+	}
+}
+
+// NewRenderer constructs a Renderer from the given options.
+func NewRenderer(opts ...RendererOption) *Renderer {
+	var cfg rendererConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	env := cfg.env
+	if env == nil {
+		env = gonja.DefaultEnvironment
+	}
+	if len(cfg.filters) > 0 {
+		env = withFilterSet(env, cfg.filters)
+	}
+
+	cache := cfg.cache
+	if cache == nil {
+		cache = defaultTemplateCache
+	}
+
+	return &Renderer{
+		env:            env,
+		strict:         cfg.strict,
+		templateBinary: cfg.templateBinary,
+		cache:          cache,
+		delimiters:     cfg.delimiters,
+		whitespace:     cfg.whitespace,
+		autoEscape:     cfg.autoEscape,
+	}
+}
+
+// RenderString renders a template string.
+func (r *Renderer) RenderString(tpl string, vars map[string]any) (string, error) {
+	return r.renderString(context.Background(), tpl, vars, nil)
+}
+
+// RenderBytes renders template bytes. Binary content is returned unchanged
+// unless the Renderer was built WithTemplateBinary.
+func (r *Renderer) RenderBytes(raw []byte, vars map[string]any) ([]byte, error) {
+	return r.renderBytes(context.Background(), raw, vars, nil)
+}
+
+// RenderFile is like RenderBytes but wraps failures in a RenderError naming
+// the file.
+func (r *Renderer) RenderFile(name string, data []byte, vars map[string]any) ([]byte, error) {
+	out, err := r.RenderBytes(data, vars)
+	if err != nil {
+		return nil, &RenderError{Kind: RenderErrorFile, Path: name, Err: err}
+	}
+	return out, nil
+}
+
+// Copy is like the package-level Copy but renders with r. The template
+// settings of opts (Environment, StrictVariables, TemplateBinary,
+// TemplateCache, Delimiters, Whitespace, AutoEscape, BuiltinFilters and
+// Renderer) are ignored.
+func (r *Renderer) Copy(source fs.FS, dest Writer, opts Options) (Stats, error) {
+	return r.CopyContext(context.Background(), source, dest, opts)
+}
+
+// CopyContext is like Copy but stops as soon as ctx is done.
+func (r *Renderer) CopyContext(ctx context.Context, source fs.FS, dest Writer, opts Options) (Stats, error) {
+	opts.Renderer = r
+	return CopyContext(ctx, source, dest, opts)
+}
+
+// withFilterSet returns a copy of env whose filter set also holds filters.
+func withFilterSet(env *exec.Environment, filters map[string]exec.FilterFunction) *exec.Environment {
+	return &exec.Environment{
+		Context:           env.Context,
+		Filters:           exec.NewFilterSet(map[string]exec.FilterFunction{}).Update(env.Filters).Update(exec.NewFilterSet(filters)),
+		Tests:             env.Tests,
+		ControlStructures: env.ControlStructures,
+		Methods:           env.Methods,
+	}
+}
+
+// builtinFilterEnvironment returns env, or the default environment when nil,
+// with the filters of the renderfs/filters package added. The copy is kept
+// in cache, so that templates compiled against it are reused between calls.
+func builtinFilterEnvironment(cache *TemplateCache, env *exec.Environment) *exec.Environment {
+	if env == nil {
+		env = gonja.DefaultEnvironment
+	}
+	return cache.environment(env, "builtin filters", func() *exec.Environment {
+		return withFilterSet(env, filters.Filters())
+	})
+}
+
+// renderer returns the Renderer configured by the options.
+func (o Options) renderer() *Renderer {
+	if o.Renderer != nil {
+		return o.Renderer
+	}
+	cache := o.TemplateCache
+	if cache == nil {
+		cache = defaultTemplateCache
+	}
+	env := o.Environment
+	if o.BuiltinFilters {
+		env = builtinFilterEnvironment(cache, env)
+	}
+	return NewRenderer(
+		WithEnvironment(env),
+		WithStrictVariables(o.StrictVariables),
+		WithTemplateBinary(o.TemplateBinary),
+		WithTemplateCache(cache),
+		WithDelimiters(o.Delimiters),
+		WithWhitespace(o.Whitespace),
+		WithAutoEscape(o.AutoEscape),
+	)
+}
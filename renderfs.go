@@ -1,3 +1,47 @@
+// Package renderfs renders a tree of Gonja templates from an fs.FS into a
+// destination Writer. Plan renders every path and file template, and Apply
+// or Copy write the result.
+//
+// # Includes
+//
+// File templates may include, import or extend other files of the source
+// filesystem. Relative names resolve against the directory of the including
+// file and absolute names against the source root; names escaping the source
+// filesystem are rejected. Names not found next to the including file are
+// looked up in Options.PartialsDir and then in each of Options.Partials.
+//
+// # Loops in names
+//
+// A file or directory whose name is a single for loop over a list in the
+// context, such as "{% for svc in services %}{{ svc.name }}{% endfor %}", is
+// planned once per element, with the loop variable available to its content
+// and to every path beneath it. Elements whose name renders empty are
+// skipped. The list must be a plain or dotted variable such as "services" or
+// "app.services".
+//
+// # Several outputs per file
+//
+// The file tag, "{% file "envs/" ~ env ~ ".yaml" %}...{% endfile %}", renders
+// its body into a separate file whose path is relative to the directory of
+// the template. A template that emits any file produces only the emitted
+// files.
+//
+// # Front matter
+//
+// A file template may start with a YAML block between two "---" lines, which
+// is removed from its output. "output" is a path template replacing the
+// rendered name, "mode" sets the permission bits in octal, "skip_if" leaves
+// the file out when its expression is true, "on_conflict" is "overwrite",
+// "skip" or "fail", and "render: false" copies the rest of the file without
+// rendering it. A block containing other keys is rendered as content.
+//
+// # Source functions
+//
+// File templates can call read_file(path), glob(pattern), exists(path) and
+// file_hash(path), which look at the source filesystem without rendering
+// anything. Names resolve like include; file_hash returns the hex SHA-256 of
+// the file. The paths they look at are recorded in Operation.Dependencies,
+// and context variables of the same names take precedence.
 package renderfs
 
 import (
@@ -27,6 +71,23 @@ const (
 	Fail
 )
 
+// SymlinkPolicy defines how Copy treats a destination path that is a symlink
+// when the source entry is a regular file. It only applies to writers that
+// implement LstatWriter.
+type SymlinkPolicy int
+
+const (
+	// FollowSymlinks compares against and writes through the link, modifying
+	// the file it points to.
+	FollowSymlinks SymlinkPolicy = iota
+	// ReplaceSymlinks treats the link as differing content: OnConflict
+	// decides, and overwriting removes the link and writes a regular file.
+	// The destination must implement RemoveWriter.
+	ReplaceSymlinks
+	// FailOnSymlinks aborts with a RenderErrorSymlink error.
+	FailOnSymlinks
+)
+
 // Options configures the behaviour of the Copy operation.
 type Options struct {
 	// Context provides template data when rendering path and file contents.
@@ -37,6 +98,41 @@ type Options struct {
 	// When nil, gonja.DefaultEnvironment is used.
 	Environment *exec.Environment
 
+	// TemplateCache holds compiled templates between calls. When nil, a
+	// bounded package-level cache is used.
+	TemplateCache *TemplateCache
+
+	// Renderer renders paths and file contents. When set, Environment,
+	// StrictVariables, TemplateBinary, TemplateCache, Delimiters,
+	// Whitespace, AutoEscape and BuiltinFilters are ignored.
+	Renderer *Renderer
+
+	// Delimiters overrides the template delimiters of paths and file
+	// contents, for example "[[" and "]]" for variables. Empty fields keep
+	// the defaults.
+	Delimiters Delimiters
+
+	// Whitespace controls how block tags affect the surrounding whitespace
+	// and whether a trailing newline is kept.
+	Whitespace Whitespace
+
+	// AutoEscape HTML-escapes every printed value.
+	AutoEscape bool
+
+	// BuiltinFilters makes the filters of the renderfs/filters package, such
+	// as snake_case, to_yaml and go_identifier, available on top of
+	// Environment or the default environment, which is not modified. The
+	// extended copy is kept in TemplateCache, so that compiled templates are
+	// reused between calls.
+	BuiltinFilters bool
+
+	// TemplateOverrides select other delimiters and template settings for
+	// the paths and contents of matching source entries, such as ".github/"
+	// for workflows using ${{ }}. Settings an override leaves unset keep
+	// those used for the rest of the tree, and the last matching override
+	// wins.
+	TemplateOverrides []TemplateOverride
+
 	// StrictVariables causes rendering to fail if a template references
 	// an undefined variable.
 	StrictVariables bool
@@ -46,14 +142,87 @@ type Options struct {
 	// Detection uses http.DetectContentType on the first 512 bytes.
 	TemplateBinary bool
 
+	// TemplateSuffixOnly renders only files whose name ends with one of
+	// TemplateSuffixes and copies every other file byte for byte, so that
+	// files using {{ for another tool, such as Helm charts or GitHub Actions
+	// workflows, survive unchanged. Paths are rendered either way.
+	TemplateSuffixOnly bool
+
+	// TemplateSuffixes lists the suffixes stripped from rendered file names,
+	// the first match winning. Defaults to ".jinja" and ".tmpl", or to
+	// ".jinja" alone when TemplateSuffixOnly is set.
+	TemplateSuffixes []string
+
+	// Transactional makes Apply journal every change to the destination and,
+	// when an operation fails or the context is canceled, restore the
+	// destination exactly and report zero Stats. The destination must
+	// implement LstatWriter and RemoveWriter; see Transaction. The original
+	// content of every overwritten file is staged in a temporary file until
+	// Apply returns, needing as much free space in os.TempDir.
+	Transactional bool
+
 	// OnConflict controls how Copy reacts when the destination file already exists.
 	// Defaults to Overwrite when left zero-valued.
 	OnConflict ConflictResolution
 
-	// IgnorePatterns contains gitignore-style patterns that should be excluded
-	// from the copy. When empty, Copy looks for a .renderfs-ignore file at the
-	// root of the source filesystem.
+	// OnSymlink controls how Copy treats destination files that are symlinks.
+	// Defaults to FollowSymlinks when left zero-valued.
+	OnSymlink SymlinkPolicy
+
+	// ConfineSymlinks rejects symlinks whose rendered target is absolute or
+	// resolves outside the destination root. Targets are always rendered with
+	// Context like paths.
+	ConfineSymlinks bool
+
+	// DereferenceSymlinks copies the files and directories that symlinks in
+	// the source point to instead of recreating the links. Links that are
+	// absolute or lead outside the source filesystem fail with a
+	// RenderErrorPath error unless DereferenceExternalSymlinks is set.
+	DereferenceSymlinks bool
+
+	// DereferenceExternalSymlinks lets DereferenceSymlinks copy what source
+	// links outside the source filesystem point to, such as host files.
+	DereferenceExternalSymlinks bool
+
+	// CaseInsensitiveCollisions also reports source entries whose rendered
+	// paths only differ in case, which would overwrite each other on
+	// case-insensitive filesystems such as the macOS default. Entries
+	// rendering to exactly the same path are always reported.
+	CaseInsensitiveCollisions bool
+
+	// Concurrency is the number of files whose contents are rendered in
+	// parallel. Paths are still rendered and directories still created in
+	// walk order, Stats do not depend on it, and when several files fail the
+	// error of the lexically first path is returned. Only rendering runs in
+	// parallel: the destination is read from a single goroutine, in walk
+	// order, so Writer implementations need not be safe for concurrent use.
+	// Values below 2 render sequentially.
+	Concurrency int
+
+	// IgnorePatterns contains gitignore-style patterns, relative to the source
+	// root, that should be excluded from the copy. They are merged with the
+	// .renderfs-ignore files found in the source: each of those is rendered
+	// with Context first and its patterns apply relative to its directory,
+	// like nested .gitignore files.
 	IgnorePatterns []string
+
+	// CopyWithoutRender contains gitignore-style patterns, relative to the
+	// source root, of files whose contents are never rendered but streamed
+	// byte for byte, such as vendored bundles or templates for other engines.
+	// Their paths are still rendered. The copy_without_render list of the
+	// source's .renderfs.yaml file adds to them.
+	CopyWithoutRender []string
+
+	// PartialsDir names a directory of the source filesystem, such as
+	// "_partials", holding files that templates can include, import or
+	// extend by name from anywhere in the tree. The directory itself is
+	// never copied. Empty disables the convention.
+	PartialsDir string
+
+	// Partials mounts additional filesystems, such as an embed.FS of shared
+	// macros, that are searched in order after PartialsDir. Files are
+	// addressed relative to each filesystem's root and are never copied.
+	Partials []fs.FS
 }
 
 // Writer abstracts the destination that rendered files and directories are
@@ -76,3 +245,17 @@ type Writer interface {
 	// return an error satisfying fs.ErrNotExist.
 	Open(path string) (io.ReadCloser, error)
 }
+
+// LstatWriter is implemented by writers that can describe destination paths
+// without following symlinks. Copy uses it to detect missing files and size
+// changes without reading existing content.
+type LstatWriter interface {
+	Lstat(path string) (fs.FileInfo, error)
+}
+
+// Aborter is implemented by handles returned from Writer.CreateFile that can
+// discard everything written so far. When writing a file fails, Apply calls
+// Abort instead of Close so that no partial file is left behind.
+type Aborter interface {
+	Abort() error
+}
@@ -2,15 +2,25 @@ package renderfs_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"testing/fstest"
+	"testing/iotest"
+	"time"
 
 	"github.com/greyhoundhq/renderfs"
 	"github.com/greyhoundhq/renderfs/writers"
+	"github.com/nikolalohinski/gonja/v2/exec"
 )
 
 func TestCopyBasicRendering(t *testing.T) {
@@ -129,6 +139,657 @@ func TestCopyRespectsIgnorePatterns(t *testing.T) {
 	}
 }
 
+func TestCopyNestedTemplatedIgnoreFiles(t *testing.T) {
+	source := fstest.MapFS{
+		".renderfs-ignore": {
+			Data: []byte("{% if not use_docker %}docker/{% endif %}\n"),
+		},
+		"docker/Dockerfile": {
+			Data: []byte("FROM scratch"),
+		},
+		"app/.renderfs-ignore": {
+			Data: []byte("/local.txt\n*.log\n"),
+		},
+		"app/local.txt": {
+			Data: []byte("local"),
+		},
+		"app/debug.log": {
+			Data: []byte("log"),
+		},
+		"app/sub/local.txt": {
+			Data: []byte("nested"),
+		},
+		"local.txt": {
+			Data: []byte("root"),
+		},
+		"notes.md": {
+			Data: []byte("notes"),
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+	_, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context:        map[string]any{"use_docker": false},
+		IgnorePatterns: []string{"notes.md"},
+	})
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	contents := writer.Contents()
+	for _, ignored := range []string{"docker/Dockerfile", "app/local.txt", "app/debug.log", "notes.md", ".renderfs-ignore", "app/.renderfs-ignore"} {
+		if _, ok := contents[ignored]; ok {
+			t.Fatalf("expected %s to be ignored", ignored)
+		}
+	}
+	for _, kept := range []string{"app/sub/local.txt", "local.txt"} {
+		if _, ok := contents[kept]; !ok {
+			t.Fatalf("expected %s to be copied", kept)
+		}
+	}
+
+	writer = writers.NewMemoryWriter()
+	if _, err := renderfs.Copy(source, writer, renderfs.Options{Context: map[string]any{"use_docker": true}}); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if _, ok := writer.Contents()["docker/Dockerfile"]; !ok {
+		t.Fatalf("expected docker/Dockerfile to be copied when use_docker is true")
+	}
+}
+
+func TestPlanDetectsRenderedPathCollisions(t *testing.T) {
+	source := fstest.MapFS{
+		"README.md": {
+			Data: []byte("plain"),
+		},
+		"README.md.jinja": {
+			Data: []byte("templated"),
+		},
+	}
+
+	_, err := renderfs.Plan(source, nil, renderfs.Options{})
+	var renderErr *renderfs.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorCollision {
+		t.Fatalf("expected collision error, got %v", err)
+	}
+	if renderErr.Other != "README.md" || renderErr.Path != "README.md.jinja" {
+		t.Fatalf("expected both source paths, got %q and %q", renderErr.Other, renderErr.Path)
+	}
+
+	source = fstest.MapFS{
+		"{{ name }}/main.go": {
+			Data: []byte("package main"),
+		},
+		"App/main.go": {
+			Data: []byte("package app"),
+		},
+		"{{ name }}/docs/a.md": {
+			Data: []byte("a"),
+		},
+		"app/docs/b.md": {
+			Data: []byte("b"),
+		},
+	}
+	opts := renderfs.Options{Context: map[string]any{"name": "app"}}
+	if _, err := renderfs.Plan(source, nil, opts); err != nil {
+		t.Fatalf("expected merged directories and case-distinct files to plan, got %v", err)
+	}
+
+	opts.CaseInsensitiveCollisions = true
+	_, err = renderfs.Plan(source, nil, opts)
+	if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorCollision {
+		t.Fatalf("expected case-insensitive collision error, got %v", err)
+	}
+	if renderErr.Other != "App/main.go" || renderErr.Path != "{{ name }}/main.go" {
+		t.Fatalf("unexpected colliding paths %q and %q", renderErr.Other, renderErr.Path)
+	}
+}
+
+func TestCopyExpandsPathsPerListElement(t *testing.T) {
+	source := fstest.MapFS{
+		"services/{% for svc in app.services %}{{ svc.name }}{% endfor %}/main.go.jinja": {
+			Data: []byte("// {{ svc.name }} listens on {{ svc.port }}"),
+		},
+		"services/{% for svc in app.services %}{{ svc.name }}{% endfor %}/{{ svc.name }}.yaml": {
+			Data: []byte("port: {{ svc.port }}"),
+		},
+		"{% for env in envs %}{% if env != 'skip' %}{{ env }}.env{% endif %}{% endfor %}": {
+			Data: []byte("ENV={{ env }}"),
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+	_, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context: map[string]any{
+			"app": map[string]any{
+				"services": []map[string]any{
+					{"name": "api", "port": 8080},
+					{"name": "worker", "port": 9090},
+				},
+			},
+			"envs": []string{"dev", "skip", "prod"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	want := map[string]string{
+		"services/api/main.go":        "// api listens on 8080",
+		"services/api/api.yaml":       "port: 8080",
+		"services/worker/main.go":     "// worker listens on 9090",
+		"services/worker/worker.yaml": "port: 9090",
+		"dev.env":                     "ENV=dev",
+		"prod.env":                    "ENV=prod",
+	}
+	contents := writer.Contents()
+	if len(contents) != len(want) {
+		t.Fatalf("expected %d files, got %d", len(want), len(contents))
+	}
+	for p, content := range want {
+		if got := string(contents[p]); got != content {
+			t.Fatalf("expected %s to contain %q, got %q", p, content, got)
+		}
+	}
+
+	_, err = renderfs.Plan(source, nil, renderfs.Options{
+		Context: map[string]any{"envs": []string{"dev", "dev"}},
+	})
+	var renderErr *renderfs.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorCollision {
+		t.Fatalf("expected collision error for repeated elements, got %v", err)
+	}
+}
+
+func TestCopyFileTagEmitsMultipleFiles(t *testing.T) {
+	source := fstest.MapFS{
+		"deploy/manifests.jinja": {
+			Data: []byte("ignored{% for env in envs %}{% file \"envs/\" ~ env ~ \".yaml\" %}env: {{ env }}{% endfile %}{% endfor %}"),
+		},
+		"README.md": {Data: []byte("{{ name }}")},
+	}
+
+	writer := writers.NewMemoryWriter()
+	stats, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context: map[string]any{"name": "demo", "envs": []string{"dev", "prod"}},
+	})
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if stats.Created != 3 {
+		t.Fatalf("expected 3 created files, got %+v", stats)
+	}
+
+	want := map[string]string{
+		"deploy/envs/dev.yaml":  "env: dev",
+		"deploy/envs/prod.yaml": "env: prod",
+		"README.md":             "demo",
+	}
+	contents := writer.Contents()
+	if len(contents) != len(want) {
+		t.Fatalf("expected %d files, got %v", len(want), contents)
+	}
+	for p, content := range want {
+		if got := string(contents[p]); got != content {
+			t.Fatalf("expected %s to contain %q, got %q", p, content, got)
+		}
+	}
+
+	escaping := fstest.MapFS{
+		"out.jinja": {Data: []byte("{% file \"../../secret\" %}x{% endfile %}")},
+	}
+	_, err = renderfs.Plan(escaping, nil, renderfs.Options{})
+	var renderErr *renderfs.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorFile || renderErr.Path != "out.jinja" {
+		t.Fatalf("expected render error for escaping emitted path, got %v", err)
+	}
+}
+
+func TestCopyFrontMatterDirectives(t *testing.T) {
+	source := fstest.MapFS{
+		"bin/run.sh.jinja": {
+			Data: []byte("---\noutput: \"{{ name }}.sh\"\nmode: 0755\n---\necho {{ name }}\n"),
+		},
+		"debug.txt": {
+			Data: []byte("---\nskip_if: not debug\n---\ndebug"),
+		},
+		"raw.txt": {
+			Data: []byte("---\nrender: false\n---\n{{ kept }}"),
+		},
+		"config.yaml": {
+			Data: []byte("---\nname: {{ name }}\n---\n"),
+		},
+		"notes.txt": {
+			Data: []byte("---\non_conflict: skip\n---\nnew"),
+		},
+		"private.txt": {
+			Data: []byte("---\nmode: 600\n---\nsecret"),
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+	existing, err := writer.CreateFile("notes.txt", 0o644)
+	if err != nil {
+		t.Fatalf("prepare destination file: %v", err)
+	}
+	if _, err := existing.Write([]byte("old")); err != nil {
+		t.Fatalf("write original: %v", err)
+	}
+	existing.Close()
+
+	stats, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context: map[string]any{"name": "deploy", "debug": false},
+	})
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if stats.Created != 4 || stats.Skipped != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	contents := writer.Contents()
+	want := map[string]string{
+		"private.txt":   "secret",
+		"bin/deploy.sh": "echo deploy\n",
+		"raw.txt":       "{{ kept }}",
+		"config.yaml":   "---\nname: deploy\n---\n",
+		"notes.txt":     "old",
+	}
+	if len(contents) != len(want) {
+		t.Fatalf("expected %d files, got %v", len(want), contents)
+	}
+	for p, content := range want {
+		if got := string(contents[p]); got != content {
+			t.Fatalf("expected %s to contain %q, got %q", p, content, got)
+		}
+	}
+	if mode, ok := writer.FileMode("bin/deploy.sh"); !ok || mode.Perm() != 0o755 {
+		t.Fatalf("expected front matter mode 0755, got %v", mode)
+	}
+	if mode, ok := writer.FileMode("private.txt"); !ok || mode.Perm() != 0o600 {
+		t.Fatalf("expected front matter mode 600 to be read as octal, got %v", mode)
+	}
+
+	invalid := fstest.MapFS{"bad.txt": {Data: []byte("---\nmode: 800\n---\n")}}
+	if _, err := renderfs.Copy(invalid, writers.NewMemoryWriter(), renderfs.Options{}); err == nil || !strings.Contains(err.Error(), `invalid front matter mode "800"`) {
+		t.Fatalf("expected an invalid mode error, got %v", err)
+	}
+
+	unquoted := fstest.MapFS{"run.sh": {Data: []byte("---\noutput: {{ name }}.sh\n---\necho\n")}}
+	_, err = renderfs.Copy(unquoted, writers.NewMemoryWriter(), renderfs.Options{Context: map[string]any{"name": "deploy"}})
+	var renderErr *renderfs.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorFile || renderErr.Path != "run.sh" {
+		t.Fatalf("expected a front matter parse error naming run.sh, got %v", err)
+	}
+}
+
+func TestPlanClaimsPathsAfterFrontMatter(t *testing.T) {
+	source := fstest.MapFS{
+		"a.txt":        {Data: []byte("plain")},
+		"a.txt.jinja":  {Data: []byte("---\noutput: b.txt\n---\nmoved")},
+		"gen.txt":      {Data: []byte("plain")},
+		"gen.txt.tmpl": {Data: []byte("{% file \"emitted.txt\" %}emitted{% endfile %}")},
+	}
+	plan, err := renderfs.Plan(source, nil, renderfs.Options{})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	var paths []string
+	for _, op := range plan.Operations {
+		paths = append(paths, op.Path)
+	}
+	if want := []string{"a.txt", "b.txt", "gen.txt", "emitted.txt"}; !slices.Equal(paths, want) {
+		t.Fatalf("expected paths %v, got %v", want, paths)
+	}
+
+	colliding := fstest.MapFS{
+		"a.txt.jinja": {Data: []byte("---\noutput: c.txt\n---\n")},
+		"c.txt":       {Data: []byte("plain")},
+	}
+	_, err = renderfs.Plan(colliding, nil, renderfs.Options{})
+	var renderErr *renderfs.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorCollision || renderErr.Path != "c.txt" || renderErr.Other != "a.txt.jinja" {
+		t.Fatalf("expected a collision with the moved file, got %v", err)
+	}
+}
+
+func TestCopyTemplateSuffixOnly(t *testing.T) {
+	source := fstest.MapFS{
+		"{{ name }}/values.yaml.jinja": {Data: []byte("name: {{ name }}")},
+		"{{ name }}/deployment.yaml":   {Data: []byte("image: {{ .Values.image }}")},
+		"workflow.yml.tmpl":            {Data: []byte("run: ${{ matrix.go }}")},
+		"README.md.tpl":                {Data: []byte("# {{ name }}")},
+	}
+
+	writer := writers.NewMemoryWriter()
+	if _, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context:            map[string]any{"name": "chart"},
+		TemplateSuffixOnly: true,
+	}); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	want := map[string]string{
+		"chart/values.yaml":     "name: chart",
+		"chart/deployment.yaml": "image: {{ .Values.image }}",
+		"workflow.yml.tmpl":     "run: ${{ matrix.go }}",
+		"README.md.tpl":         "# {{ name }}",
+	}
+	contents := writer.Contents()
+	if len(contents) != len(want) {
+		t.Fatalf("expected %d files, got %v", len(want), contents)
+	}
+	for p, content := range want {
+		if got := string(contents[p]); got != content {
+			t.Fatalf("expected %s to contain %q, got %q", p, content, got)
+		}
+	}
+
+	writer = writers.NewMemoryWriter()
+	if _, err := renderfs.Copy(fstest.MapFS{"README.md.tpl": source["README.md.tpl"]}, writer, renderfs.Options{
+		Context:            map[string]any{"name": "chart"},
+		TemplateSuffixOnly: true,
+		TemplateSuffixes:   []string{".tpl"},
+	}); err != nil {
+		t.Fatalf("Copy with custom suffixes failed: %v", err)
+	}
+	if got := string(writer.Contents()["README.md"]); got != "# chart" {
+		t.Fatalf("expected README.md rendered with custom suffix, got %q", got)
+	}
+}
+
+func TestCopyWithoutRender(t *testing.T) {
+	source := fstest.MapFS{
+		".renderfs.yaml":               {Data: []byte("copy_without_render:\n  - \"*.tpl\"\n")},
+		"{{ name }}/vendor/app.min.js": {Data: []byte("x={{a}}")},
+		"{{ name }}/page.html.tpl":     {Data: []byte("<h1>{{ title }}</h1>")},
+		"{{ name }}/README.md":         {Data: []byte("# {{ name }}")},
+		"docs/example.jinja":           {Data: []byte("{{ shipped }}")},
+	}
+
+	writer := writers.NewMemoryWriter()
+	if _, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context:           map[string]any{"name": "site"},
+		CopyWithoutRender: []string{"vendor/", "docs/*.jinja"},
+	}); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	want := map[string]string{
+		"site/vendor/app.min.js": "x={{a}}",
+		"site/page.html.tpl":     "<h1>{{ title }}</h1>",
+		"site/README.md":         "# site",
+		"docs/example":           "{{ shipped }}",
+	}
+	contents := writer.Contents()
+	if len(contents) != len(want) {
+		t.Fatalf("expected %d files, got %v", len(want), contents)
+	}
+	for p, content := range want {
+		if got := string(contents[p]); got != content {
+			t.Fatalf("expected %s to contain %q, got %q", p, content, got)
+		}
+	}
+
+	_, err := renderfs.Plan(fstest.MapFS{".renderfs.yaml": {Data: []byte("copy_without_rendr: []\n")}}, nil, renderfs.Options{})
+	if err == nil {
+		t.Fatalf("expected error for unknown configuration key")
+	}
+}
+
+func TestCopyDelimiters(t *testing.T) {
+	source := fstest.MapFS{
+		"{{ name }}/main.go":               {Data: []byte("package {{ name }}")},
+		".github/workflows/[[ name ]].yml": {Data: []byte("run: go test ${{ matrix.pkg }} # [[ name ]]")},
+		"{% for svc in services %}[[ svc ]]{% endfor %}.txt": {
+			Data: []byte("{{ svc }}"),
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+	if _, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context: map[string]any{"name": "demo", "services": []string{"api"}},
+		TemplateOverrides: []renderfs.TemplateOverride{
+			{Pattern: ".github/", Delimiters: renderfs.Delimiters{VariableStart: "[[", VariableEnd: "]]"}},
+			{Pattern: "*.txt", Delimiters: renderfs.Delimiters{VariableStart: "[[", VariableEnd: "]]"}},
+		},
+	}); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	want := map[string]string{
+		"demo/main.go":               "package demo",
+		".github/workflows/demo.yml": "run: go test ${{ matrix.pkg }} # demo",
+		"api.txt":                    "{{ svc }}",
+	}
+	contents := writer.Contents()
+	if len(contents) != len(want) {
+		t.Fatalf("expected %d files, got %v", len(want), contents)
+	}
+	for p, content := range want {
+		if got := string(contents[p]); got != content {
+			t.Fatalf("expected %s to contain %q, got %q", p, content, got)
+		}
+	}
+
+	writer = writers.NewMemoryWriter()
+	if _, err := renderfs.Copy(fstest.MapFS{
+		"<< name >>.txt": {Data: []byte("<% if name %><< name >><% endif %> {{ kept }}")},
+	}, writer, renderfs.Options{
+		Context: map[string]any{"name": "demo"},
+		Delimiters: renderfs.Delimiters{
+			BlockStart: "<%", BlockEnd: "%>",
+			VariableStart: "<<", VariableEnd: ">>",
+		},
+	}); err != nil {
+		t.Fatalf("Copy with global delimiters failed: %v", err)
+	}
+	if got := string(writer.Contents()["demo.txt"]); got != "demo {{ kept }}" {
+		t.Fatalf("expected demo.txt rendered with custom delimiters, got %q", got)
+	}
+}
+
+func TestCopyWhitespaceControls(t *testing.T) {
+	template := []byte("items:\n  {% for i in items %}\n  - {{ i }}\n  {% endfor %}\n")
+	source := fstest.MapFS{
+		"list.yaml":     {Data: template},
+		"raw/list.yaml": {Data: template},
+		"page.html":     {Data: []byte("<p>{{ title }}</p>\n")},
+	}
+
+	keep := false
+	enable := true
+	writer := writers.NewMemoryWriter()
+	if _, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context:    map[string]any{"items": []string{"a", "b"}, "title": "<b>"},
+		Whitespace: renderfs.Whitespace{TrimBlocks: true, LeftStripBlocks: true},
+		TemplateOverrides: []renderfs.TemplateOverride{
+			{Pattern: "raw/", TrimBlocks: &keep, LeftStripBlocks: &keep},
+			{Pattern: "*.html", AutoEscape: &enable, TrimTrailingNewline: &enable},
+		},
+	}); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	want := map[string]string{
+		"list.yaml":     "items:\n  - a\n  - b\n",
+		"raw/list.yaml": "items:\n  \n  - a\n  \n  - b\n  \n",
+		"page.html":     "<p>&lt;b&gt;</p>",
+	}
+	contents := writer.Contents()
+	for p, content := range want {
+		if got := string(contents[p]); got != content {
+			t.Fatalf("expected %s to contain %q, got %q", p, content, got)
+		}
+	}
+
+	cache := renderfs.NewTemplateCache(8)
+	tpl := "{% if true %}\nyes{% endif %}"
+	for _, tc := range []struct {
+		whitespace renderfs.Whitespace
+		want       string
+	}{
+		{renderfs.Whitespace{}, "\nyes"},
+		{renderfs.Whitespace{TrimBlocks: true}, "yes"},
+	} {
+		r := renderfs.NewRenderer(renderfs.WithTemplateCache(cache), renderfs.WithWhitespace(tc.whitespace))
+		got, err := r.RenderString(tpl, nil)
+		if err != nil {
+			t.Fatalf("RenderString failed: %v", err)
+		}
+		if got != tc.want {
+			t.Fatalf("expected %q with %+v, got %q", tc.want, tc.whitespace, got)
+		}
+	}
+}
+
+func TestCopyBuiltinFilters(t *testing.T) {
+	source := fstest.MapFS{
+		"{{ name | snake_case }}/{{ name | kebab_case }}.go": {
+			Data: []byte("package {{ name | go_identifier }}"),
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+	if _, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context:        map[string]any{"name": "MyService"},
+		BuiltinFilters: true,
+	}); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if got := string(writer.Contents()["my_service/my-service.go"]); got != "package myService" {
+		t.Fatalf("expected rendered file with builtin filters, got %v", writer.Contents())
+	}
+
+	if _, err := renderfs.Plan(source, nil, renderfs.Options{Context: map[string]any{"name": "x"}}); err == nil {
+		t.Fatalf("expected builtin filters to be disabled by default")
+	}
+
+	opts := renderfs.Options{
+		Context:        map[string]any{"name": "MyService"},
+		BuiltinFilters: true,
+		TemplateCache:  renderfs.NewTemplateCache(16),
+	}
+	for range 2 {
+		if _, err := renderfs.Plan(source, nil, opts); err != nil {
+			t.Fatalf("Plan failed: %v", err)
+		}
+	}
+	if stats := opts.TemplateCache.Stats(); stats.Misses == 0 || stats.Hits != stats.Misses {
+		t.Fatalf("expected the second plan to reuse every compiled template, got %+v", stats)
+	}
+
+	// Reset drops the extended environment along with the templates compiled
+	// against it, and the next calls share a new one.
+	opts.TemplateCache.Reset()
+	for range 2 {
+		if _, err := renderfs.Plan(source, nil, opts); err != nil {
+			t.Fatalf("Plan failed: %v", err)
+		}
+	}
+	if stats := opts.TemplateCache.Stats(); stats.Misses == 0 || stats.Hits != stats.Misses {
+		t.Fatalf("expected the plans after Reset to share compiled templates, got %+v", stats)
+	}
+}
+
+func TestPlanSourceFunctions(t *testing.T) {
+	source := fstest.MapFS{
+		"db/migrations/001_init.sql":  {Data: []byte("CREATE TABLE users;")},
+		"db/migrations/002_posts.sql": {Data: []byte("CREATE TABLE posts;")},
+		"db/index.md": {
+			Data: []byte("{% for m in glob('migrations/*.sql') %}{{ m }}: {{ read_file(m) }}\n{% endfor %}" +
+				"{{ exists('/README.md') }} {{ exists('seed.sql') }} {{ file_hash('/db/migrations/001_init.sql')[:8] }}"),
+		},
+		"README.md": {Data: []byte("{{ name }}")},
+	}
+
+	plan, err := renderfs.Plan(source, nil, renderfs.Options{Context: map[string]any{"name": "demo"}})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+
+	var index *renderfs.Operation
+	for i := range plan.Operations {
+		if plan.Operations[i].Path == "db/index.md" {
+			index = &plan.Operations[i]
+		}
+	}
+	if index == nil {
+		t.Fatalf("expected an operation for db/index.md")
+	}
+	want := "migrations/001_init.sql: CREATE TABLE users;\n" +
+		"migrations/002_posts.sql: CREATE TABLE posts;\n" +
+		"True False cdd1a879"
+	if got := string(index.Data); got != want {
+		t.Fatalf("expected index %q, got %q", want, got)
+	}
+	wantDeps := []string{
+		"README.md",
+		"db/migrations/*.sql",
+		"db/migrations/001_init.sql",
+		"db/migrations/002_posts.sql",
+		"db/seed.sql",
+	}
+	if !slices.Equal(index.Dependencies, wantDeps) {
+		t.Fatalf("expected dependencies %v, got %v", wantDeps, index.Dependencies)
+	}
+
+	escaping := fstest.MapFS{"out.txt": {Data: []byte("{{ read_file('../../etc/passwd') }}")}}
+	if _, err := renderfs.Plan(escaping, nil, renderfs.Options{}); err == nil || !strings.Contains(err.Error(), "escapes the source filesystem") {
+		t.Fatalf("expected read_file outside the source to fail, got %v", err)
+	}
+}
+
+func TestPlanSourceFunctionsCannotFollowSymlinksOutOfSource(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sourceDir := filepath.Join(root, "source")
+	if err := os.MkdirAll(filepath.Join(sourceDir, "_p"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sourceDir, "_p", "data.txt"), []byte("data"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink("data.txt", filepath.Join(sourceDir, "_p", "alias")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(sourceDir, "_p", "h")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := os.Symlink(root, filepath.Join(sourceDir, "_p", "up")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	opts := renderfs.Options{PartialsDir: "_p"}
+	write := func(tpl string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(sourceDir, "out.txt"), []byte(tpl), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	write("{{ read_file('_p/alias') }}")
+	plan, err := renderfs.Plan(os.DirFS(sourceDir), nil, opts)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if len(plan.Operations) != 1 || string(plan.Operations[0].Data) != "data" {
+		t.Fatalf("expected the link inside the source to be read, got %+v", plan.Operations)
+	}
+
+	for _, tpl := range []string{
+		"{{ read_file('_p/h') }}",
+		"{{ file_hash('_p/h') }}",
+		"{{ exists('_p/up/secret.txt') }}",
+		"{{ glob('_p/up/*') }}",
+	} {
+		write(tpl)
+		if _, err := renderfs.Plan(os.DirFS(sourceDir), nil, opts); err == nil || !strings.Contains(err.Error(), "outside the source filesystem") {
+			t.Fatalf("%s: expected the escaping link to be rejected, got %v", tpl, err)
+		}
+	}
+}
+
 func TestCopyConflictHandling(t *testing.T) {
 	source := fstest.MapFS{
 		"file.txt": {
@@ -278,11 +939,314 @@ func TestCopySkipSymlinkDestination(t *testing.T) {
 	}
 }
 
-func TestCopyDirectoryDestinationErrors(t *testing.T) {
-	dest := t.TempDir()
-	writer, err := writers.NewOSWriter(dest)
-	if err != nil {
-		t.Fatalf("NewOSWriter: %v", err)
+func TestCopySymlinkDestinationPolicies(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlink tests require elevated privileges on Windows")
+	}
+
+	source := fstest.MapFS{
+		"file.txt": {
+			Data: []byte("new"),
+			Mode: 0o644,
+		},
+	}
+
+	prepare := func(t *testing.T) (*writers.OSWriter, string) {
+		dest := t.TempDir()
+		writer, err := writers.NewOSWriter(dest)
+		if err != nil {
+			t.Fatalf("NewOSWriter: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dest, "target.txt"), []byte("original"), 0o644); err != nil {
+			t.Fatalf("write target: %v", err)
+		}
+		if err := os.Symlink("target.txt", filepath.Join(dest, "file.txt")); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+		return writer, dest
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		writer, dest := prepare(t)
+		stats, err := renderfs.Copy(source, writer, renderfs.Options{OnSymlink: renderfs.ReplaceSymlinks})
+		if err != nil {
+			t.Fatalf("Copy failed: %v", err)
+		}
+		if stats.Updated != 1 {
+			t.Fatalf("expected 1 updated file, got %+v", stats)
+		}
+		info, err := os.Lstat(filepath.Join(dest, "file.txt"))
+		if err != nil || !info.Mode().IsRegular() {
+			t.Fatalf("expected file.txt to be a regular file, got %v (%v)", info, err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(dest, "target.txt")); string(got) != "original" {
+			t.Fatalf("expected link target unchanged, got %q", got)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		writer, dest := prepare(t)
+		_, err := renderfs.Copy(source, writer, renderfs.Options{OnSymlink: renderfs.FailOnSymlinks})
+		var renderErr *renderfs.RenderError
+		if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorSymlink || renderErr.Path != "file.txt" {
+			t.Fatalf("expected symlink error for file.txt, got %v", err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(dest, "target.txt")); string(got) != "original" {
+			t.Fatalf("expected link target unchanged, got %q", got)
+		}
+	})
+}
+
+func TestCopyAtomicWritesThroughSymlinks(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	if err := os.MkdirAll(filepath.Join(dest, "data"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "data", "real.txt"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink(filepath.Join("data", "real.txt"), filepath.Join(dest, "link.txt")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "outside.txt"), []byte("host"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink(filepath.Join("..", "outside.txt"), filepath.Join(dest, "escape.txt")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	writer, err := writers.NewOSWriter(dest)
+	if err != nil {
+		t.Fatalf("NewOSWriter: %v", err)
+	}
+	writer.Atomic = true
+	stats, err := renderfs.Copy(fstest.MapFS{"link.txt": {Data: []byte("new")}}, writer, renderfs.Options{})
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if stats.Updated != 1 {
+		t.Fatalf("expected 1 update, got %+v", stats)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "link.txt")); err != nil || target != filepath.Join("data", "real.txt") {
+		t.Fatalf("expected the link to be kept, got %q (%v)", target, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "data", "real.txt")); string(got) != "new" {
+		t.Fatalf("expected the write to go through the link, got %q", got)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dest, "data")); len(entries) != 1 {
+		t.Fatalf("expected no temporary files to remain, found %d entries", len(entries))
+	}
+
+	_, err = renderfs.Copy(fstest.MapFS{"escape.txt": {Data: []byte("new")}}, writer, renderfs.Options{})
+	if !errors.Is(err, writers.ErrPathEscapes) {
+		t.Fatalf("expected writing through an escaping link to fail, got %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(root, "outside.txt")); string(got) != "host" {
+		t.Fatalf("expected the host file to be untouched, got %q", got)
+	}
+}
+
+func TestCopySymlinkSourceConflicts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlink tests require elevated privileges on Windows")
+	}
+
+	source := fstest.MapFS{
+		"current": {
+			Data: []byte("v2"),
+			Mode: fs.ModeSymlink | 0o777,
+		},
+		"same": {
+			Data: []byte("v1"),
+			Mode: fs.ModeSymlink | 0o777,
+		},
+	}
+
+	dest := t.TempDir()
+	writer, err := writers.NewOSWriter(dest)
+	if err != nil {
+		t.Fatalf("NewOSWriter: %v", err)
+	}
+	for _, name := range []string{"current", "same"} {
+		if err := os.Symlink("v1", filepath.Join(dest, name)); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+	}
+
+	stats, err := renderfs.Copy(source, writer, renderfs.Options{OnConflict: renderfs.Skip})
+	if err != nil {
+		t.Fatalf("Copy with skip failed: %v", err)
+	}
+	if stats.Skipped != 1 || stats.Identical != 1 {
+		t.Fatalf("expected 1 skipped and 1 identical symlink, got %+v", stats)
+	}
+
+	stats, err = renderfs.Copy(source, writer, renderfs.Options{})
+	if err != nil {
+		t.Fatalf("Copy with overwrite failed: %v", err)
+	}
+	if stats != (renderfs.Stats{Updated: 1, Identical: 1}) {
+		t.Fatalf("expected 1 updated and 1 identical symlink, got %+v", stats)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "current")); err != nil || target != "v2" {
+		t.Fatalf("expected current to be relinked to v2, got %q (%v)", target, err)
+	}
+
+	_, err = renderfs.Copy(fstest.MapFS{"current": {Data: []byte("v3"), Mode: fs.ModeSymlink | 0o777}}, writer, renderfs.Options{OnConflict: renderfs.Fail})
+	var renderErr *renderfs.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorConflict {
+		t.Fatalf("expected conflict error, got %v", err)
+	}
+}
+
+func TestCopyRendersSymlinkTargets(t *testing.T) {
+	source := fstest.MapFS{
+		"releases/current": {
+			Data: []byte("{{ version }}"),
+			Mode: fs.ModeSymlink | 0o777,
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+	stats, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context:         map[string]any{"version": "v1.2.0"},
+		ConfineSymlinks: true,
+	})
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if stats != (renderfs.Stats{Created: 1}) {
+		t.Fatalf("expected the symlink to count as created, got %+v", stats)
+	}
+	if target, err := writer.ReadLink("releases/current"); err != nil || target != "v1.2.0" {
+		t.Fatalf("expected rendered target v1.2.0, got %q (%v)", target, err)
+	}
+
+	for _, target := range []string{"/etc/shadow", "../../etc/shadow", "{{ escape }}"} {
+		source := fstest.MapFS{
+			"releases/evil": {
+				Data: []byte(target),
+				Mode: fs.ModeSymlink | 0o777,
+			},
+		}
+		_, err := renderfs.Copy(source, writers.NewMemoryWriter(), renderfs.Options{
+			Context:         map[string]any{"escape": "../.."},
+			ConfineSymlinks: true,
+		})
+		var renderErr *renderfs.RenderError
+		if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorPath || renderErr.Path != "releases/evil" {
+			t.Fatalf("expected target %q to be rejected, got %v", target, err)
+		}
+	}
+}
+
+func TestCopyDereferenceSymlinks(t *testing.T) {
+	source := fstest.MapFS{
+		"shared/config.yaml": {
+			Data: []byte("name: {{ name }}"),
+		},
+		"app/config.yaml": {
+			Data: []byte("../shared/config.yaml"),
+			Mode: fs.ModeSymlink | 0o777,
+		},
+		"linked": {
+			Data: []byte("shared"),
+			Mode: fs.ModeSymlink | 0o777,
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+	if _, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context:             map[string]any{"name": "demo"},
+		DereferenceSymlinks: true,
+	}); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	contents := writer.Contents()
+	for _, p := range []string{"app/config.yaml", "linked/config.yaml", "shared/config.yaml"} {
+		if got := string(contents[p]); got != "name: demo" {
+			t.Fatalf("expected %s to hold the rendered content, got %q", p, got)
+		}
+	}
+	if _, err := writer.ReadLink("linked"); err == nil {
+		t.Fatalf("expected linked to be copied as a directory, not a symlink")
+	}
+
+	loop := fstest.MapFS{
+		"dir/self": {
+			Data: []byte("."),
+			Mode: fs.ModeSymlink | 0o777,
+		},
+	}
+	_, err := renderfs.Copy(loop, writers.NewMemoryWriter(), renderfs.Options{DereferenceSymlinks: true})
+	if err == nil || !strings.Contains(err.Error(), "too many levels of symlinks") {
+		t.Fatalf("expected symlink cycle error, got %v", err)
+	}
+}
+
+func TestCopyDereferenceSymlinksStayInSource(t *testing.T) {
+	root := t.TempDir()
+	outside := filepath.Join(root, "secret.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sourceDir := filepath.Join(root, "source")
+	if err := os.MkdirAll(filepath.Join(sourceDir, "shared"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sourceDir, "shared", "config.yaml"), []byte("ok"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink(filepath.Join("shared", "config.yaml"), filepath.Join(sourceDir, "config.yaml")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+
+	opts := renderfs.Options{DereferenceSymlinks: true}
+	writer := writers.NewMemoryWriter()
+	if _, err := renderfs.Copy(os.DirFS(sourceDir), writer, opts); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if got := string(writer.Contents()["config.yaml"]); got != "ok" {
+		t.Fatalf("expected the link inside the source to be dereferenced, got %q", got)
+	}
+
+	for name, target := range map[string]string{
+		"absolute": outside,
+		"relative": filepath.Join("..", "secret.txt"),
+	} {
+		link := filepath.Join(sourceDir, "evil")
+		os.Remove(link)
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+		writer := writers.NewMemoryWriter()
+		_, err := renderfs.Copy(os.DirFS(sourceDir), writer, opts)
+		var renderErr *renderfs.RenderError
+		if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorPath || renderErr.Path != "evil" {
+			t.Fatalf("%s: expected the escaping link to be rejected, got %v", name, err)
+		}
+		if _, ok := writer.Contents()["evil"]; ok {
+			t.Fatalf("%s: expected the host file not to be copied", name)
+		}
+
+		external := opts
+		external.DereferenceExternalSymlinks = true
+		writer = writers.NewMemoryWriter()
+		if _, err := renderfs.Copy(os.DirFS(sourceDir), writer, external); err != nil {
+			t.Fatalf("%s: Copy with external links failed: %v", name, err)
+		}
+		if got := string(writer.Contents()["evil"]); got != "secret" {
+			t.Fatalf("%s: expected the opted-in link to be dereferenced, got %q", name, got)
+		}
+	}
+}
+
+func TestCopyDirectoryDestinationErrors(t *testing.T) {
+	dest := t.TempDir()
+	writer, err := writers.NewOSWriter(dest)
+	if err != nil {
+		t.Fatalf("NewOSWriter: %v", err)
 	}
 	if err := os.Mkdir(filepath.Join(dest, "file.txt"), 0o755); err != nil {
 		t.Fatalf("mkdir: %v", err)
@@ -389,3 +1353,977 @@ func TestCopyTemplatesBinaryWhenEnabled(t *testing.T) {
 		t.Fatalf("expected binary content templated, got %q", got)
 	}
 }
+
+func TestPlanDoesNotTouchDestination(t *testing.T) {
+	source := fstest.MapFS{
+		"docs": {
+			Mode: fs.ModeDir | 0o755,
+		},
+		"docs/guide.md": {
+			Data: []byte("# {{ title }}\n"),
+		},
+		"same.txt": {
+			Data: []byte("same"),
+		},
+		"changed.txt": {
+			Data: []byte("new"),
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+	for name, content := range map[string]string{"same.txt": "same", "changed.txt": "old"} {
+		handle, err := writer.CreateFile(name, 0o644)
+		if err != nil {
+			t.Fatalf("prepare %s: %v", name, err)
+		}
+		if _, err := handle.Write([]byte(content)); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		handle.Close()
+	}
+
+	plan, err := renderfs.Plan(source, writer, renderfs.Options{Context: map[string]any{"title": "Guide"}})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+
+	kinds := map[string]renderfs.OperationKind{}
+	for _, op := range plan.Operations {
+		kinds[op.Path] = op.Kind
+	}
+	want := map[string]renderfs.OperationKind{
+		"docs":          renderfs.OpMkdir,
+		"docs/guide.md": renderfs.OpCreate,
+		"same.txt":      renderfs.OpIdentical,
+		"changed.txt":   renderfs.OpUpdate,
+	}
+	for p, kind := range want {
+		if kinds[p] != kind {
+			t.Fatalf("expected %s to be planned as %s, got %q", p, kind, kinds[p])
+		}
+	}
+
+	if _, ok := writer.Contents()["docs/guide.md"]; ok {
+		t.Fatalf("Plan must not write to the destination")
+	}
+	if got := string(writer.Contents()["changed.txt"]); got != "old" {
+		t.Fatalf("Plan must not modify existing files, got %q", got)
+	}
+
+	stats, err := renderfs.Apply(plan, writer)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if stats != plan.Stats() {
+		t.Fatalf("expected Apply stats %+v to match plan stats %+v", stats, plan.Stats())
+	}
+	if stats.Created != 1 || stats.Updated != 1 || stats.Identical != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if got := string(writer.Contents()["docs/guide.md"]); got != "# Guide\n" {
+		t.Fatalf("unexpected guide content: %q", got)
+	}
+}
+
+func TestCopyRenderErrorWritesNothing(t *testing.T) {
+	source := fstest.MapFS{
+		"a.txt": {
+			Data: []byte("fine"),
+		},
+		"z.txt": {
+			Data: []byte("{{ missing }}"),
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+
+	_, err := renderfs.Copy(source, writer, renderfs.Options{StrictVariables: true})
+	if err == nil {
+		t.Fatalf("expected render error")
+	}
+	if len(writer.Contents()) != 0 {
+		t.Fatalf("expected no files written, got %v", writer.Contents())
+	}
+}
+
+func TestDiffUnifiedOutput(t *testing.T) {
+	source := fstest.MapFS{
+		"config.yaml": {
+			Data: []byte("name: {{ name }}\nport: 8080\nlog: info\n"),
+		},
+		"new.txt": {
+			Data: []byte("hello\n"),
+		},
+		"logo.png": {
+			Data: []byte("\x89PNG\r\n\x1a\nnew"),
+		},
+		"same.txt": {
+			Data: []byte("same\n"),
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+	for name, content := range map[string]string{
+		"config.yaml": "name: old\nport: 8080\nlog: info\n",
+		"logo.png":    "\x89PNG\r\n\x1a\nold",
+		"same.txt":    "same\n",
+		"stale.txt":   "bye",
+	} {
+		handle, err := writer.CreateFile(name, 0o644)
+		if err != nil {
+			t.Fatalf("prepare %s: %v", name, err)
+		}
+		if _, err := handle.Write([]byte(content)); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		handle.Close()
+	}
+
+	plan, err := renderfs.Plan(source, writer, renderfs.Options{Context: map[string]any{"name": "demo"}})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+
+	diffs, err := renderfs.Diff(plan, writer, renderfs.DiffOptions{IncludeOnlyInDestination: true})
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+
+	got := map[string]renderfs.FileDiff{}
+	for _, d := range diffs {
+		got[d.Path] = d
+	}
+	if len(got) != 4 {
+		t.Fatalf("expected 4 diffs, got %d: %+v", len(got), diffs)
+	}
+
+	want := "--- a/config.yaml\n+++ b/config.yaml\n@@ -1,3 +1,3 @@\n-name: old\n+name: demo\n port: 8080\n log: info\n"
+	if d := got["config.yaml"]; d.Kind != renderfs.DiffUpdate || d.Unified != want {
+		t.Fatalf("unexpected config diff (%s):\n%s", d.Kind, d.Unified)
+	}
+
+	want = "--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1 @@\n+hello\n"
+	if d := got["new.txt"]; d.Kind != renderfs.DiffCreate || d.Unified != want {
+		t.Fatalf("unexpected create diff (%s):\n%s", d.Kind, d.Unified)
+	}
+
+	want = "Binary files a/logo.png and b/logo.png differ\n"
+	if d := got["logo.png"]; !d.Binary || d.Unified != want {
+		t.Fatalf("unexpected binary diff:\n%s", d.Unified)
+	}
+
+	want = "--- a/stale.txt\n+++ /dev/null\n@@ -1 +0,0 @@\n-bye\n\\ No newline at end of file\n"
+	if d := got["stale.txt"]; d.Kind != renderfs.DiffOnlyInDestination || d.Unified != want {
+		t.Fatalf("unexpected destination-only diff (%s):\n%s", d.Kind, d.Unified)
+	}
+}
+
+func TestNewFileDiffSplitsDistantHunks(t *testing.T) {
+	var oldContent, newContent bytes.Buffer
+	for i := 1; i <= 20; i++ {
+		line := []byte{byte('a' + i - 1), '\n'}
+		oldContent.Write(line)
+		if i == 2 || i == 19 {
+			newContent.WriteString("changed\n")
+			continue
+		}
+		newContent.Write(line)
+	}
+
+	d := renderfs.NewFileDiff(renderfs.DiffUpdate, "letters.txt", oldContent.Bytes(), newContent.Bytes(), 1)
+	want := "--- a/letters.txt\n+++ b/letters.txt\n" +
+		"@@ -1,3 +1,3 @@\n a\n-b\n+changed\n c\n" +
+		"@@ -18,3 +18,3 @@\n r\n-s\n+changed\n t\n"
+	if d.Unified != want {
+		t.Fatalf("unexpected diff:\n%s", d.Unified)
+	}
+}
+
+func TestNewFileDiffLargeFiles(t *testing.T) {
+	var oldContent, sparse, rewritten bytes.Buffer
+	for i := range 10000 {
+		fmt.Fprintf(&oldContent, "line %d\n", i)
+		if i%100 == 50 {
+			fmt.Fprintf(&sparse, "changed %d\n", i)
+		} else {
+			fmt.Fprintf(&sparse, "line %d\n", i)
+		}
+		fmt.Fprintf(&rewritten, "other %d\n", i)
+	}
+
+	count := func(unified string) (removed, added int) {
+		for _, line := range strings.Split(unified, "\n") {
+			switch {
+			case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "+++"):
+			case strings.HasPrefix(line, "-"):
+				removed++
+			case strings.HasPrefix(line, "+"):
+				added++
+			}
+		}
+		return removed, added
+	}
+
+	d := renderfs.NewFileDiff(renderfs.DiffUpdate, "big.txt", oldContent.Bytes(), sparse.Bytes(), 0)
+	if removed, added := count(d.Unified); removed != 100 || added != 100 {
+		t.Fatalf("expected a minimal diff of 100 changed lines, got -%d +%d", removed, added)
+	}
+	d = renderfs.NewFileDiff(renderfs.DiffUpdate, "big.txt", oldContent.Bytes(), rewritten.Bytes(), 0)
+	if removed, added := count(d.Unified); removed != 10000 || added != 10000 {
+		t.Fatalf("expected every line to be replaced, got -%d +%d", removed, added)
+	}
+}
+
+func TestDiffReadersStopsAtBinaryHead(t *testing.T) {
+	// Reading past the first 512 bytes of either side fails, so the diff has
+	// to be built from the heads alone.
+	limited := func(head string) io.Reader {
+		padded := head + strings.Repeat("\x00", 512-len(head))
+		return io.MultiReader(strings.NewReader(padded), iotest.ErrReader(errors.New("read past the head")))
+	}
+
+	d, err := renderfs.DiffReaders(renderfs.DiffUpdate, "logo.png", limited("\x89PNG\r\n\x1a\nold"), limited("\x89PNG\r\n\x1a\nnew"), 0)
+	if err != nil {
+		t.Fatalf("DiffReaders failed: %v", err)
+	}
+	if want := "Binary files a/logo.png and b/logo.png differ\n"; !d.Binary || d.Unified != want {
+		t.Fatalf("unexpected binary diff:\n%s", d.Unified)
+	}
+
+	d, err = renderfs.DiffReaders(renderfs.DiffUpdate, "data.bin", strings.NewReader("text\n"), limited("\x00\x01"), 0)
+	if err != nil {
+		t.Fatalf("DiffReaders failed: %v", err)
+	}
+	if !d.Binary {
+		t.Fatalf("expected a binary diff, got:\n%s", d.Unified)
+	}
+
+	text := io.MultiReader(strings.NewReader(strings.Repeat("b\n", 256)), iotest.ErrReader(errors.New("read past the head")))
+	if _, err := renderfs.DiffReaders(renderfs.DiffUpdate, "big.txt", strings.NewReader("a\n"), text, 0); err == nil {
+		t.Fatalf("expected text content to be read in full")
+	}
+}
+
+func TestCopyIncludesResolveWithinSource(t *testing.T) {
+	source := fstest.MapFS{
+		"docs/header.txt": {
+			Data: []byte("# {{ title }}"),
+		},
+		"docs/page.md": {
+			Data: []byte("{% include \"header.txt\" %}\nbody"),
+		},
+		"base.html": {
+			Data: []byte("<main>{% block content %}{% endblock %}</main>"),
+		},
+		"pages/index.html": {
+			Data: []byte("{% extends \"/base.html\" %}{% block content %}hi{% endblock %}"),
+		},
+		"macros.j2": {
+			Data: []byte("{% macro shout(s) %}{{ s | upper }}{% endmacro %}"),
+		},
+		"pages/shout.txt": {
+			Data: []byte("{% import \"../macros.j2\" as m %}{{ m.shout('hey') }}"),
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+
+	_, err := renderfs.Copy(source, writer, renderfs.Options{Context: map[string]any{"title": "Guide"}})
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	contents := writer.Contents()
+	if got := string(contents["docs/page.md"]); got != "# Guide\nbody" {
+		t.Fatalf("unexpected include output: %q", got)
+	}
+	if got := string(contents["pages/index.html"]); got != "<main>hi</main>" {
+		t.Fatalf("unexpected extends output: %q", got)
+	}
+	if got := string(contents["pages/shout.txt"]); got != "HEY" {
+		t.Fatalf("unexpected import output: %q", got)
+	}
+}
+
+func TestCopyIncludesCannotEscapeSource(t *testing.T) {
+	tests := map[string]string{
+		"absolute host path": "{% include \"/etc/passwd\" %}",
+		"parent traversal":   "{% include \"../../etc/passwd\" %}",
+	}
+
+	for name, tpl := range tests {
+		t.Run(name, func(t *testing.T) {
+			source := fstest.MapFS{
+				"sub/file.txt": {
+					Data: []byte(tpl),
+				},
+			}
+
+			writer := writers.NewMemoryWriter()
+			_, err := renderfs.Copy(source, writer, renderfs.Options{})
+			if err == nil {
+				t.Fatalf("expected include to fail")
+			}
+
+			var renderErr *renderfs.RenderError
+			if !errors.As(err, &renderErr) || renderErr.Path != "sub/file.txt" {
+				t.Fatalf("expected RenderError for sub/file.txt, got %v", err)
+			}
+			if len(writer.Contents()) != 0 {
+				t.Fatalf("expected nothing written, got %v", writer.Contents())
+			}
+		})
+	}
+}
+
+func TestCopyIncludesCannotFollowSymlinksOutOfSource(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sourceDir := filepath.Join(root, "source")
+	if err := os.MkdirAll(filepath.Join(sourceDir, "_p"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sourceDir, "_p", "license.txt"), []byte("MIT"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink("license.txt", filepath.Join(sourceDir, "_p", "copying")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join("..", "..", "secret.txt"), filepath.Join(sourceDir, "_p", "h")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	opts := renderfs.Options{PartialsDir: "_p"}
+	if err := os.WriteFile(filepath.Join(sourceDir, "file.txt"), []byte("{% include \"copying\" %}"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	writer := writers.NewMemoryWriter()
+	if _, err := renderfs.Copy(os.DirFS(sourceDir), writer, opts); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if got := string(writer.Contents()["file.txt"]); got != "MIT" {
+		t.Fatalf("expected the link inside the source to be included, got %q", got)
+	}
+
+	if err := os.WriteFile(filepath.Join(sourceDir, "file.txt"), []byte("{% include \"_p/h\" %}"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	writer = writers.NewMemoryWriter()
+	_, err := renderfs.Copy(os.DirFS(sourceDir), writer, opts)
+	var renderErr *renderfs.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Path != "file.txt" || !strings.Contains(err.Error(), "escapes the source") {
+		t.Fatalf("expected the escaping include to be rejected, got %v", err)
+	}
+	if len(writer.Contents()) != 0 {
+		t.Fatalf("expected nothing written, got %v", writer.Contents())
+	}
+}
+
+func TestCopyPartialsAreIncludableButNotCopied(t *testing.T) {
+	shared := fstest.MapFS{
+		"macros.j2": {
+			Data: []byte("{% macro banner(s) %}== {{ s | upper }} =={% endmacro %}"),
+		},
+		"ci/footer.txt": {
+			Data: []byte("{% include \"note.txt\" %}"),
+		},
+		"ci/note.txt": {
+			Data: []byte("generated"),
+		},
+	}
+	source := fstest.MapFS{
+		"_partials/license.txt": {
+			Data: []byte("// Copyright {{ owner }}"),
+		},
+		"cmd/app/main.go": {
+			Data: []byte("{% include \"license.txt\" %}\npackage main"),
+		},
+		"README.md": {
+			Data: []byte("{% import \"macros.j2\" as m %}{{ m.banner('docs') }}\n{% include \"ci/footer.txt\" %}"),
+		},
+	}
+
+	writer := writers.NewMemoryWriter()
+
+	stats, err := renderfs.Copy(source, writer, renderfs.Options{
+		Context:     map[string]any{"owner": "Greyhound"},
+		PartialsDir: "_partials/",
+		Partials:    []fs.FS{shared},
+	})
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if stats.Created != 2 {
+		t.Fatalf("expected 2 created files, got %d", stats.Created)
+	}
+
+	contents := writer.Contents()
+	if got := string(contents["cmd/app/main.go"]); got != "// Copyright Greyhound\npackage main" {
+		t.Fatalf("unexpected main.go content: %q", got)
+	}
+	if got := string(contents["README.md"]); got != "== DOCS ==\ngenerated" {
+		t.Fatalf("unexpected README content: %q", got)
+	}
+	if _, ok := contents["_partials/license.txt"]; ok {
+		t.Fatalf("partials must not be copied")
+	}
+	if _, ok := writer.DirMode("_partials"); ok {
+		t.Fatalf("partials directory must not be created")
+	}
+}
+
+type cancelingWriter struct {
+	*writers.MemoryWriter
+	cancelAt string
+	cancel   context.CancelFunc
+}
+
+func (w cancelingWriter) CreateFile(p string, perm fs.FileMode) (io.WriteCloser, error) {
+	if p == w.cancelAt {
+		w.cancel()
+	}
+	return w.MemoryWriter.CreateFile(p, perm)
+}
+
+func TestCopyContextCanceledBeforeStart(t *testing.T) {
+	source := fstest.MapFS{
+		"file.txt": {
+			Data: []byte("hello"),
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	writer := writers.NewMemoryWriter()
+	stats, err := renderfs.CopyContext(ctx, source, writer, renderfs.Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	var renderErr *renderfs.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorCanceled {
+		t.Fatalf("expected canceled RenderError, got %v", err)
+	}
+	if stats != (renderfs.Stats{}) || len(writer.Contents()) != 0 {
+		t.Fatalf("expected nothing written, got stats %+v", stats)
+	}
+}
+
+func TestCopyContextReportsPartialStats(t *testing.T) {
+	source := fstest.MapFS{
+		"a.txt": {
+			Data: []byte("a"),
+		},
+		"b.txt": {
+			Data: []byte("b"),
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer := cancelingWriter{MemoryWriter: writers.NewMemoryWriter(), cancelAt: "b.txt", cancel: cancel}
+	stats, err := renderfs.CopyContext(ctx, source, writer, renderfs.Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if stats.Created != 1 {
+		t.Fatalf("expected only a.txt to be counted, got %+v", stats)
+	}
+	if got := string(writer.Contents()["b.txt"]); got != "" {
+		t.Fatalf("expected b.txt not to be written after cancellation, got %q", got)
+	}
+}
+
+func TestPlanContextStopsDuringRender(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := fstest.MapFS{
+		"big.txt": {
+			Data: []byte("{{ stop() }}{% for i in range(100000) %}{{ i }}{% endfor %}"),
+		},
+	}
+	vars := map[string]any{
+		"stop": func() string {
+			cancel()
+			return ""
+		},
+	}
+
+	_, err := renderfs.PlanContext(ctx, source, nil, renderfs.Options{Context: vars})
+	var renderErr *renderfs.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorCanceled || renderErr.Path != "big.txt" {
+		t.Fatalf("expected canceled RenderError for big.txt, got %v", err)
+	}
+}
+
+func TestCopyConcurrencyMatchesSequential(t *testing.T) {
+	source := fstest.MapFS{}
+	for i := 0; i < 200; i++ {
+		source[fmt.Sprintf("pkg%02d/file%03d.txt", i%10, i)] = &fstest.MapFile{
+			Data: []byte(fmt.Sprintf("{{ name }}-%d{%% for j in range(%d) %%}.{%% endfor %%}", i, i%7)),
+		}
+	}
+	opts := renderfs.Options{Context: map[string]any{"name": "svc"}}
+
+	sequential := writers.NewMemoryWriter()
+	seqStats, err := renderfs.Copy(source, sequential, opts)
+	if err != nil {
+		t.Fatalf("sequential Copy failed: %v", err)
+	}
+
+	opts.Concurrency = 8
+	parallel := writers.NewMemoryWriter()
+	parStats, err := renderfs.Copy(source, parallel, opts)
+	if err != nil {
+		t.Fatalf("parallel Copy failed: %v", err)
+	}
+
+	if seqStats != parStats {
+		t.Fatalf("expected identical stats, got %+v and %+v", seqStats, parStats)
+	}
+	want, got := sequential.Contents(), parallel.Contents()
+	if len(want) != len(got) {
+		t.Fatalf("expected %d files, got %d", len(want), len(got))
+	}
+	for p, content := range want {
+		if !bytes.Equal(got[p], content) {
+			t.Fatalf("content mismatch for %s: %q vs %q", p, got[p], content)
+		}
+	}
+}
+
+func TestPlanConcurrencyReportsFirstFailingPath(t *testing.T) {
+	source := fstest.MapFS{}
+	for i := 0; i < 50; i++ {
+		data := "ok"
+		if i%5 == 3 {
+			data = "{{ missing }}"
+		}
+		source[fmt.Sprintf("file%02d.txt", i)] = &fstest.MapFile{Data: []byte(data)}
+	}
+
+	for run := 0; run < 20; run++ {
+		_, err := renderfs.Plan(source, nil, renderfs.Options{StrictVariables: true, Concurrency: 8})
+		var renderErr *renderfs.RenderError
+		if !errors.As(err, &renderErr) || renderErr.Path != "file03.txt" {
+			t.Fatalf("expected error for file03.txt, got %v", err)
+		}
+	}
+}
+
+// serialWriter records the destination paths opened during planning and
+// whether two calls ever overlapped.
+type serialWriter struct {
+	*writers.MemoryWriter
+	active     atomic.Int32
+	overlapped atomic.Bool
+	opened     []string
+}
+
+func (w *serialWriter) enter() {
+	if w.active.Add(1) > 1 {
+		w.overlapped.Store(true)
+	}
+	time.Sleep(50 * time.Microsecond)
+}
+
+func (w *serialWriter) Open(p string) (io.ReadCloser, error) {
+	w.enter()
+	defer w.active.Add(-1)
+	w.opened = append(w.opened, p)
+	return w.MemoryWriter.Open(p)
+}
+
+func (w *serialWriter) Lstat(p string) (fs.FileInfo, error) {
+	w.enter()
+	defer w.active.Add(-1)
+	return w.MemoryWriter.Lstat(p)
+}
+
+func TestPlanConcurrencyReadsDestinationSequentially(t *testing.T) {
+	source := fstest.MapFS{}
+	dest := &serialWriter{MemoryWriter: writers.NewMemoryWriter()}
+	var want []string
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("file%02d.txt", i)
+		source[name] = &fstest.MapFile{Data: []byte(fmt.Sprintf("{{ name }} %d", i))}
+		existing, err := dest.MemoryWriter.CreateFile(name, 0o644)
+		if err != nil {
+			t.Fatalf("prepare destination: %v", err)
+		}
+		fmt.Fprintf(existing, "old %d", i)
+		existing.Close()
+		want = append(want, name)
+	}
+
+	plan, err := renderfs.Plan(source, dest, renderfs.Options{Context: map[string]any{"name": "svc"}, Concurrency: 8})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if dest.overlapped.Load() {
+		t.Fatalf("expected the destination to be read by one goroutine at a time")
+	}
+	if !slices.Equal(dest.opened, want) {
+		t.Fatalf("expected destination files to be read in walk order, got %v", dest.opened)
+	}
+	if stats := plan.Stats(); stats.Updated != 40 {
+		t.Fatalf("expected 40 updates, got %+v", stats)
+	}
+}
+
+func TestTemplateCacheCountsAndEvicts(t *testing.T) {
+	source := fstest.MapFS{
+		"{{ a }}.txt": {Data: []byte("a")},
+		"{{ b }}.txt": {Data: []byte("b")},
+		"{{ c }}.txt": {Data: []byte("c")},
+	}
+	opts := renderfs.Options{
+		Context:       map[string]any{"a": "x", "b": "y", "c": "z"},
+		TemplateCache: renderfs.NewTemplateCache(2),
+	}
+
+	if _, err := renderfs.Plan(source, nil, opts); err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	stats := opts.TemplateCache.Stats()
+	if stats.Hits != 0 || stats.Misses != 6 || stats.Entries != 2 {
+		t.Fatalf("unexpected stats after first plan: %+v", stats)
+	}
+
+	// Walking a → b → c again through a two-entry LRU evicts each path and
+	// content just before it is needed.
+	if _, err := renderfs.Plan(source, nil, opts); err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	stats = opts.TemplateCache.Stats()
+	if stats.Entries != 2 || stats.Hits != 0 || stats.Misses != 12 {
+		t.Fatalf("unexpected stats after second plan: %+v", stats)
+	}
+
+	opts.TemplateCache.Reset()
+	if stats := opts.TemplateCache.Stats(); stats != (renderfs.CacheStats{}) {
+		t.Fatalf("expected empty stats after Reset, got %+v", stats)
+	}
+}
+
+func TestTemplateCacheHitsForRepeatedPaths(t *testing.T) {
+	source := fstest.MapFS{
+		"{{ name }}.txt": {Data: []byte("a")},
+	}
+	opts := renderfs.Options{
+		Context:       map[string]any{"name": "x"},
+		TemplateCache: renderfs.NewTemplateCache(0),
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := renderfs.Plan(source, nil, opts); err != nil {
+			t.Fatalf("Plan failed: %v", err)
+		}
+	}
+	if stats := opts.TemplateCache.Stats(); stats.Hits != 4 || stats.Misses != 2 || stats.Entries != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestTemplateCacheSharesContentAcrossFiles(t *testing.T) {
+	source := fstest.MapFS{}
+	for i := range 8 {
+		source[fmt.Sprintf("dir%d/app.conf", i)] = &fstest.MapFile{Data: []byte("name={{ name }}\n")}
+	}
+	opts := renderfs.Options{
+		Context:       map[string]any{"name": "x"},
+		TemplateCache: renderfs.NewTemplateCache(0),
+	}
+
+	if _, err := renderfs.Plan(source, nil, opts); err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	// Every path differs, so each hit is a file reusing the content template
+	// compiled for the first one.
+	if stats := opts.TemplateCache.Stats(); stats.Hits != 7 {
+		t.Fatalf("expected files with the same content to share a template, got %+v", stats)
+	}
+
+	// The cached template is executed by several workers at once.
+	opts.Concurrency = 8
+	plan, err := renderfs.Plan(source, nil, opts)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	for _, op := range plan.Operations {
+		if op.Data != nil && string(op.Data) != "name=x\n" {
+			t.Fatalf("unexpected content for %s: %q", op.Path, op.Data)
+		}
+	}
+}
+
+func TestRendererOptions(t *testing.T) {
+	shout := func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+		return exec.AsValue(strings.ToUpper(in.String()) + "!")
+	}
+	r := renderfs.NewRenderer(
+		renderfs.WithStrictVariables(true),
+		renderfs.WithFilters(map[string]exec.FilterFunction{"shout": shout}),
+		renderfs.WithDelimiters(renderfs.Delimiters{VariableStart: "[[", VariableEnd: "]]"}),
+	)
+
+	got, err := r.RenderString("${{ github.ref }} [[ name | shout ]]", map[string]any{"name": "hi"})
+	if err != nil {
+		t.Fatalf("RenderString failed: %v", err)
+	}
+	if got != "${{ github.ref }} HI!" {
+		t.Fatalf("unexpected output: %q", got)
+	}
+
+	_, err = r.RenderFile("conf/app.yaml", []byte("[[ missing ]]"), nil)
+	var renderErr *renderfs.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Path != "conf/app.yaml" || renderErr.Kind != renderfs.RenderErrorFile {
+		t.Fatalf("expected file RenderError naming conf/app.yaml, got %v", err)
+	}
+
+	rendered, skip, err := r.RenderPath("src/[[ name ]]/main.go.jinja", false, map[string]any{"name": "demo"})
+	if err != nil || skip || rendered != "src/demo/main.go" {
+		t.Fatalf("unexpected RenderPath result %q (skip=%v, err=%v)", rendered, skip, err)
+	}
+
+	if _, err := renderfs.NewRenderer().RenderString("{{ upper }}", nil); err != nil {
+		t.Fatalf("expected lenient default renderer, got %v", err)
+	}
+}
+
+func TestRendererCopyOverridesOptions(t *testing.T) {
+	source := fstest.MapFS{
+		"[[ name ]].txt": {
+			Data: []byte("[[ name ]]"),
+		},
+	}
+
+	r := renderfs.NewRenderer(renderfs.WithDelimiters(renderfs.Delimiters{VariableStart: "[[", VariableEnd: "]]"}))
+	writer := writers.NewMemoryWriter()
+
+	_, err := r.Copy(source, writer, renderfs.Options{
+		Context:         map[string]any{"name": "demo"},
+		StrictVariables: true,
+	})
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if got := string(writer.Contents()["demo.txt"]); got != "demo" {
+		t.Fatalf("unexpected content: %q", got)
+	}
+}
+
+type countingWriter struct {
+	*writers.MemoryWriter
+	opens int
+}
+
+func (w *countingWriter) Open(p string) (io.ReadCloser, error) {
+	w.opens++
+	return w.MemoryWriter.Open(p)
+}
+
+func TestPlanStreamsBinaryFilesVerbatim(t *testing.T) {
+	blob := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0, 1, 2, '{', '{'}, 300_000)...)
+	source := fstest.MapFS{
+		"assets/logo.png": {
+			Data: blob,
+		},
+		"assets/same.png": {
+			Data: blob,
+		},
+	}
+
+	writer := &countingWriter{MemoryWriter: writers.NewMemoryWriter()}
+	existing, err := writer.CreateFile("assets/same.png", 0o644)
+	if err != nil {
+		t.Fatalf("prepare destination: %v", err)
+	}
+	existing.Write(blob)
+	existing.Close()
+
+	plan, err := renderfs.Plan(source, writer, renderfs.Options{})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	for _, op := range plan.Operations {
+		if op.Kind == renderfs.OpMkdir {
+			continue
+		}
+		if !op.Verbatim || op.Data != nil || op.Size != int64(len(blob)) {
+			t.Fatalf("expected %s to be planned verbatim without buffered data, got %+v", op.Path, op)
+		}
+	}
+
+	stats, err := renderfs.Apply(plan, writer)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if stats.Created != 1 || stats.Identical != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if got := writer.Contents()["assets/logo.png"]; !bytes.Equal(got, blob) {
+		t.Fatalf("binary content not copied byte for byte (%d bytes)", len(got))
+	}
+}
+
+func TestCopyComparesSizeBeforeContent(t *testing.T) {
+	source := fstest.MapFS{
+		"file.txt": {
+			Data: []byte("a much longer replacement"),
+		},
+	}
+
+	writer := &countingWriter{MemoryWriter: writers.NewMemoryWriter()}
+	existing, err := writer.CreateFile("file.txt", 0o644)
+	if err != nil {
+		t.Fatalf("prepare destination: %v", err)
+	}
+	existing.Write([]byte("short"))
+	existing.Close()
+
+	stats, err := renderfs.Copy(source, writer, renderfs.Options{OnConflict: renderfs.Skip})
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if stats.Skipped != 1 {
+		t.Fatalf("expected 1 skipped file, got %+v", stats)
+	}
+	if writer.opens != 0 {
+		t.Fatalf("expected differing sizes to skip reading the destination, got %d opens", writer.opens)
+	}
+}
+
+type failingWriter struct {
+	*writers.MemoryWriter
+	failAt string
+}
+
+func (w failingWriter) CreateFile(p string, perm fs.FileMode) (io.WriteCloser, error) {
+	if p == w.failAt {
+		return nil, errors.New("disk full")
+	}
+	return w.MemoryWriter.CreateFile(p, perm)
+}
+
+func TestCopyTransactionalRollsBackOnFailure(t *testing.T) {
+	source := fstest.MapFS{
+		"existing.txt": {
+			Data: []byte("new content"),
+		},
+		"keep/added.txt": {
+			Data: []byte("added"),
+		},
+		"link.txt": {
+			Data: []byte("replaces a symlink"),
+		},
+		"new/deep/file.txt": {
+			Data: []byte("created"),
+		},
+		"zz/fail.txt": {
+			Data: []byte("never written"),
+		},
+	}
+
+	memory := writers.NewMemoryWriter()
+	existing, err := memory.CreateFile("existing.txt", 0o600)
+	if err != nil {
+		t.Fatalf("prepare destination: %v", err)
+	}
+	existing.Write([]byte("original"))
+	existing.Close()
+	if err := memory.MkdirAll("keep", 0o700); err != nil {
+		t.Fatalf("prepare destination: %v", err)
+	}
+	if err := memory.Symlink("existing.txt", "link.txt"); err != nil {
+		t.Fatalf("prepare destination: %v", err)
+	}
+
+	writer := failingWriter{MemoryWriter: memory, failAt: "zz/fail.txt"}
+	stats, err := renderfs.Copy(source, writer, renderfs.Options{Transactional: true})
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("expected write failure, got %v", err)
+	}
+	if stats != (renderfs.Stats{}) {
+		t.Fatalf("expected zero stats after rollback, got %+v", stats)
+	}
+
+	contents := memory.Contents()
+	if len(contents) != 1 || string(contents["existing.txt"]) != "original" {
+		t.Fatalf("expected only the original file to remain, got %q", contents)
+	}
+	if mode, _ := memory.FileMode("existing.txt"); mode != 0o600 {
+		t.Fatalf("expected original file mode 600, got %o", mode)
+	}
+	if mode, _ := memory.DirMode("keep"); mode != 0o700 {
+		t.Fatalf("expected original dir mode 700, got %o", mode)
+	}
+	if target, err := memory.ReadLink("link.txt"); err != nil || target != "existing.txt" {
+		t.Fatalf("expected symlink to be restored, got %q (%v)", target, err)
+	}
+	for _, dir := range []string{"new", "new/deep", "zz"} {
+		if _, err := memory.Lstat(dir); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("expected created directory %s to be removed, got %v", dir, err)
+		}
+	}
+}
+
+func TestTransactionRestoresFilesWrittenThroughSymlinks(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	if err := os.Mkdir(dest, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "real.txt"), []byte("old"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink("real.txt", filepath.Join(dest, "link.txt")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "outside.txt"), []byte("host"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "outside.txt"), filepath.Join(dest, "escape.txt")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	writer, err := writers.NewOSWriter(dest)
+	if err != nil {
+		t.Fatalf("NewOSWriter: %v", err)
+	}
+	tx, err := renderfs.NewTransaction(writer)
+	if err != nil {
+		t.Fatalf("NewTransaction: %v", err)
+	}
+	handle, err := tx.CreateFile("link.txt", 0o644)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	handle.Write([]byte("new"))
+	if err := handle.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "real.txt")); string(got) != "new" {
+		t.Fatalf("expected the write to go through the link, got %q", got)
+	}
+	if _, err := tx.CreateFile("escape.txt", 0o644); err == nil || !strings.Contains(err.Error(), "outside the destination") {
+		t.Fatalf("expected writing through an escaping link to fail, got %v", err)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "real.txt")); string(got) != "old" {
+		t.Fatalf("expected the linked file to be restored, got %q", got)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "link.txt")); err != nil || target != "real.txt" {
+		t.Fatalf("expected the link to be kept, got %q (%v)", target, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(root, "outside.txt")); string(got) != "host" {
+		t.Fatalf("expected the host file to be untouched, got %q", got)
+	}
+}
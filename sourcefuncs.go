@@ -0,0 +1,233 @@
+package renderfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/nikolalohinski/gonja/v2/exec"
+)
+
+// sourceFunctions implements the read_file, glob, exists and file_hash
+// globals of a file template. Names resolve like include: relative to the
+// directory of the template, or to the source root when they start with "/".
+// They can never leave the source filesystem, not even through symlinks. Every
+// path a function looks at is recorded as a dependency of the template.
+type sourceFunctions struct {
+	source fs.FS
+	dir    string
+
+	mu   sync.Mutex
+	deps map[string]bool
+}
+
+func newSourceFunctions(source fs.FS, dir string) *sourceFunctions {
+	return &sourceFunctions{source: source, dir: dir, deps: make(map[string]bool)}
+}
+
+// addTo adds the functions to vars, except where Context already defines a
+// variable of the same name.
+func (f *sourceFunctions) addTo(vars map[string]any) {
+	for name, fn := range map[string]any{
+		"read_file": f.readFile,
+		"glob":      f.glob,
+		"exists":    f.exists,
+		"file_hash": f.fileHash,
+	} {
+		if _, ok := vars[name]; !ok {
+			vars[name] = fn
+		}
+	}
+}
+
+// dependencies returns the recorded paths in lexical order.
+func (f *sourceFunctions) dependencies() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.deps) == 0 {
+		return nil
+	}
+	deps := make([]string, 0, len(f.deps))
+	for dep := range f.deps {
+		deps = append(deps, dep)
+	}
+	slices.Sort(deps)
+	return deps
+}
+
+func (f *sourceFunctions) record(rel string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deps[rel] = true
+}
+
+// resolve returns the source path named by name, as written.
+func (f *sourceFunctions) resolve(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	joined := path.Join(f.dir, name)
+	if strings.HasPrefix(name, "/") {
+		joined = path.Clean(strings.TrimPrefix(name, "/"))
+	}
+	if joined == ".." || strings.HasPrefix(joined, "../") || !fs.ValidPath(joined) {
+		return "", fmt.Errorf("renderfs: %q escapes the source filesystem", name)
+	}
+	return joined, nil
+}
+
+// follow returns the path rel leads to once its symlinks are resolved.
+func (f *sourceFunctions) follow(fn, name, rel string) (string, error) {
+	target, err := resolveSourcePath(f.source, rel)
+	if err != nil {
+		return "", fmt.Errorf("renderfs: %s %q: %w", fn, name, err)
+	}
+	return target, nil
+}
+
+// nameArgument returns the single string argument of a call to fn.
+func nameArgument(fn string, params *exec.VarArgs) (string, error) {
+	var name string
+	if err := params.Take(exec.PositionalArgument("path", nil, exec.StringArgument(&name))); err != nil {
+		return "", exec.ErrInvalidCall(fmt.Errorf("%s: %w", fn, err))
+	}
+	return name, nil
+}
+
+// readFile implements read_file(path), returning the content of a source
+// file without rendering it.
+func (f *sourceFunctions) readFile(_ *exec.Evaluator, params *exec.VarArgs) (string, error) {
+	name, err := nameArgument("read_file", params)
+	if err != nil {
+		return "", err
+	}
+	rel, err := f.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	f.record(rel)
+	target, err := f.follow("read_file", name, rel)
+	if err != nil {
+		return "", err
+	}
+	data, err := fs.ReadFile(f.source, target)
+	if err != nil {
+		return "", fmt.Errorf("renderfs: read_file %q: %w", name, err)
+	}
+	return string(data), nil
+}
+
+// exists implements exists(path).
+func (f *sourceFunctions) exists(_ *exec.Evaluator, params *exec.VarArgs) (bool, error) {
+	name, err := nameArgument("exists", params)
+	if err != nil {
+		return false, err
+	}
+	rel, err := f.resolve(name)
+	if err != nil {
+		return false, err
+	}
+	f.record(rel)
+	target, err := f.follow("exists", name, rel)
+	if err != nil {
+		return false, err
+	}
+	_, err = fs.Stat(f.source, target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("renderfs: exists %q: %w", name, err)
+	}
+	return true, nil
+}
+
+// fileHash implements file_hash(path), the hex-encoded SHA-256 of a source
+// file.
+func (f *sourceFunctions) fileHash(_ *exec.Evaluator, params *exec.VarArgs) (string, error) {
+	name, err := nameArgument("file_hash", params)
+	if err != nil {
+		return "", err
+	}
+	rel, err := f.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	f.record(rel)
+	target, err := f.follow("file_hash", name, rel)
+	if err != nil {
+		return "", err
+	}
+	file, err := f.source.Open(target)
+	if err != nil {
+		return "", fmt.Errorf("renderfs: file_hash %q: %w", name, err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("renderfs: file_hash %q: %w", name, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// glob implements glob(pattern) with the syntax of path.Match. Matches are
+// returned in lexical order, named the way the pattern was: relative to the
+// template's directory, or with a leading "/" for patterns starting with
+// one. The pattern itself is recorded as a dependency along with every
+// match.
+func (f *sourceFunctions) glob(_ *exec.Evaluator, params *exec.VarArgs) ([]string, error) {
+	pattern, err := nameArgument("glob", params)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := f.resolve(pattern)
+	if err != nil {
+		return nil, err
+	}
+	f.record(rel)
+	matches, err := fs.Glob(f.source, rel)
+	if err != nil {
+		return nil, fmt.Errorf("renderfs: glob %q: %w", pattern, err)
+	}
+
+	absolute := strings.HasPrefix(strings.ReplaceAll(pattern, "\\", "/"), "/")
+	names := make([]string, len(matches))
+	for i, match := range matches {
+		if _, err := f.follow("glob", pattern, match); err != nil {
+			return nil, err
+		}
+		f.record(match)
+		if absolute {
+			names[i] = "/" + match
+		} else {
+			names[i] = relativePath(f.dir, match)
+		}
+	}
+	return names, nil
+}
+
+// relativePath returns the path of target, relative to the source root,
+// as seen from the directory base.
+func relativePath(base, target string) string {
+	if base == "." {
+		return target
+	}
+	baseParts := strings.Split(base, "/")
+	targetParts := strings.Split(target, "/")
+	common := 0
+	for common < len(baseParts) && common < len(targetParts)-1 && baseParts[common] == targetParts[common] {
+		common++
+	}
+	parts := make([]string, 0, len(baseParts)-common+len(targetParts)-common)
+	for range baseParts[common:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, targetParts[common:]...)
+	return strings.Join(parts, "/")
+}
@@ -2,18 +2,18 @@ package renderfs
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
-	"sync"
+	"io"
+	"strings"
 
-	"github.com/nikolalohinski/gonja/v2"
 	"github.com/nikolalohinski/gonja/v2/config"
 	"github.com/nikolalohinski/gonja/v2/exec"
 	"github.com/nikolalohinski/gonja/v2/loaders"
+	"github.com/nikolalohinski/gonja/v2/tokens"
 )
 
-var templateCache sync.Map // map[string]*exec.Template
-
 // RenderBytes renders template bytes using the provided context.
 // When templateBinary is false, binary content is returned unchanged.
 func RenderBytes(raw []byte, ctx map[string]any, templateBinary bool, strict bool) ([]byte, error) {
@@ -22,64 +22,244 @@ func RenderBytes(raw []byte, ctx map[string]any, templateBinary bool, strict boo
 
 // RenderBytesWithEnv renders template bytes using the provided context and environment.
 // When templateBinary is false, binary content is returned unchanged.
+// Templates rendered this way are not backed by a source filesystem, so
+// include, import and extends fail.
 func RenderBytesWithEnv(raw []byte, ctx map[string]any, templateBinary bool, strict bool, env *exec.Environment) ([]byte, error) {
-	if ctx == nil {
-		ctx = map[string]any{}
-	}
-	if !templateBinary && isBinary(raw) {
+	r := NewRenderer(WithEnvironment(env), WithTemplateBinary(templateBinary), WithStrictVariables(strict))
+	return r.RenderBytes(raw, ctx)
+}
+
+func (r *Renderer) renderBytes(ctx context.Context, raw []byte, vars map[string]any, loader loaders.Loader) ([]byte, error) {
+	if !r.templateBinary && isBinary(raw) {
 		return raw, nil
 	}
-	rendered, err := renderTemplateString(string(raw), ctx, strict, env)
-	if err != nil {
+	return r.renderTemplate(ctx, raw, vars, loader)
+}
+
+// renderTemplate renders raw as a template regardless of its content and
+// returns the output buffer without copying it.
+func (r *Renderer) renderTemplate(ctx context.Context, raw []byte, vars map[string]any, loader loaders.Loader) ([]byte, error) {
+	var out bytes.Buffer
+	if err := r.execute(ctx, &out, string(raw), vars, loader); err != nil {
 		return nil, err
 	}
-	return []byte(rendered), nil
+	if r.whitespace.TrimTrailingNewline {
+		return trimTrailingNewline(out.Bytes()), nil
+	}
+	return out.Bytes(), nil
 }
 
-func renderTemplateString(tpl string, ctx map[string]any, strict bool, env *exec.Environment) (string, error) {
-	compiled, err := getOrCompileTemplate(tpl, strict, env)
-	if err != nil {
+func (r *Renderer) renderString(ctx context.Context, tpl string, vars map[string]any, loader loaders.Loader) (string, error) {
+	var out strings.Builder
+	if err := r.execute(ctx, &out, tpl, vars, loader); err != nil {
 		return "", err
 	}
+	if r.whitespace.TrimTrailingNewline {
+		return string(trimTrailingNewline([]byte(out.String()))), nil
+	}
+	return out.String(), nil
+}
 
-	out, err := compiled.ExecuteToString(exec.NewContext(ctx))
-	if err != nil {
-		return "", classifyTemplateError(err)
+// trimTrailingNewline removes a single "\n" or "\r\n" from the end of out.
+func trimTrailingNewline(out []byte) []byte {
+	if !bytes.HasSuffix(out, []byte("\n")) {
+		return out
 	}
-	return out, nil
+	return bytes.TrimSuffix(out[:len(out)-1], []byte("\r"))
 }
 
-func getOrCompileTemplate(tpl string, strict bool, env *exec.Environment) (*exec.Template, error) {
-	if env == nil {
-		env = gonja.DefaultEnvironment
+// execute renders tpl with vars into w. Rendering stops with ctx.Err() as
+// soon as ctx is done.
+func (r *Renderer) execute(ctx context.Context, w io.Writer, tpl string, vars map[string]any, loader loaders.Loader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if vars == nil {
+		vars = map[string]any{}
 	}
 
-	envKey := fmt.Sprintf("%p", env)
-	cacheKey := fmt.Sprintf("%s:%t:%s", envKey, strict, tpl)
-	if cached, ok := templateCache.Load(cacheKey); ok {
-		return cached.(*exec.Template), nil
+	if loader == nil {
+		loader = noSourceLoader{}
 	}
+	loader = r.prepareLoader(loader)
 
-	cfg := config.New()
-	cfg.StrictUndefined = strict
+	compiled, err := r.compile(tpl, loader)
+	if err != nil {
+		return err
+	}
+
+	// The loader is bound here rather than when compiling, so that one
+	// compiled template serves every file with the same content.
+	env := &exec.Environment{
+		Context:           r.env.Context.Inherit().Update(exec.NewContext(vars)),
+		Filters:           r.env.Filters,
+		Tests:             r.env.Tests,
+		ControlStructures: r.env.ControlStructures,
+		Methods:           r.env.Methods,
+	}
+	renderer := exec.NewRenderer(env, contextWriter{ctx: ctx, w: w}, r.config(), loader, compiled)
+	if err := renderer.Execute(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return classifyTemplateError(fmt.Errorf("unable to execute template: %w", err))
+	}
+	return nil
+}
+
+// prepareLoader applies the template preprocessing of r, if any, to the
+// templates loader reads.
+func (r *Renderer) prepareLoader(loader loaders.Loader) loaders.Loader {
+	sl, ok := loader.(*sourceLoader)
+	if !ok || !r.whitespace.TrimBlocks {
+		return loader
+	}
+	cfg := r.config()
+	derived := *sl
+	derived.prepare = func(tpl string) string { return trimBlockNewlines(tpl, cfg) }
+	return &derived
+}
+
+// contextWriter fails every write once ctx is done, which aborts template
+// execution at the next piece of output.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
 
+// compile compiles tpl, using a cached template with the same content and
+// settings when there is one. Includes and imports are resolved through the
+// loader given at execution, but a parent template named by extends is read
+// while compiling, so templates that read from loader are not cached.
+func (r *Renderer) compile(tpl string, loader loaders.Loader) (*exec.Template, error) {
 	sum := sha256.Sum256([]byte(tpl))
-	rootID := fmt.Sprintf("root-%x", sum[:])
+	key := templateKey{
+		env:        r.env,
+		strict:     r.strict,
+		delimiters: r.delimiters,
+		trim:       r.whitespace.TrimBlocks,
+		lstrip:     r.whitespace.LeftStripBlocks,
+		autoEscape: r.autoEscape,
+		sum:        sum,
+	}
+
+	if cached, ok := r.cache.get(key); ok {
+		return cached, nil
+	}
 
-	loader, err := loaders.NewFileSystemLoader("")
+	if r.whitespace.TrimBlocks {
+		tpl = trimBlockNewlines(tpl, r.config())
+	}
+
+	tracked := &readTracker{Loader: loader, read: new(bool)}
+	rootID := fmt.Sprintf("root-%x", sum[:])
+	shiftedLoader, err := loaders.NewShiftedLoader(rootID, bytes.NewReader([]byte(tpl)), tracked)
 	if err != nil {
 		return nil, err
 	}
-	shiftedLoader, err := loaders.NewShiftedLoader(rootID, bytes.NewReader([]byte(tpl)), loader)
+
+	compiled, err := exec.NewTemplate(rootID, r.config(), shiftedLoader, r.env)
 	if err != nil {
 		return nil, err
 	}
 
-	compiled, err := exec.NewTemplate(rootID, cfg, shiftedLoader, env)
+	if !*tracked.read {
+		r.cache.put(key, compiled)
+	}
+	return compiled, nil
+}
+
+// readTracker records whether a template was read through Loader or a loader
+// inherited from it.
+type readTracker struct {
+	loaders.Loader
+	read *bool
+}
+
+func (t *readTracker) Read(name string) (io.Reader, error) {
+	*t.read = true
+	return t.Loader.Read(name)
+}
+
+func (t *readTracker) Inherit(from string) (loaders.Loader, error) {
+	inherited, err := t.Loader.Inherit(from)
 	if err != nil {
 		return nil, err
 	}
+	return &readTracker{Loader: inherited, read: t.read}, nil
+}
 
-	templateCache.Store(cacheKey, compiled)
-	return compiled, nil
+func (r *Renderer) config() *config.Config {
+	cfg := config.New()
+	cfg.StrictUndefined = r.strict
+	cfg.LeftStripBlocks = r.whitespace.LeftStripBlocks
+	cfg.AutoEscape = r.autoEscape
+
+	d := r.delimiters
+	for _, field := range []struct {
+		value  string
+		target *string
+	}{
+		{d.BlockStart, &cfg.BlockStartString},
+		{d.BlockEnd, &cfg.BlockEndString},
+		{d.VariableStart, &cfg.VariableStartString},
+		{d.VariableEnd, &cfg.VariableEndString},
+		{d.CommentStart, &cfg.CommentStartString},
+		{d.CommentEnd, &cfg.CommentEndString},
+	} {
+		if field.value != "" {
+			*field.target = field.value
+		}
+	}
+	return cfg
+}
+
+// trimBlockNewlines implements Whitespace.TrimBlocks: it removes the newline
+// directly following every block tag, except for tags closed with "+%}". The
+// TrimBlocks setting of Gonja is not used, since it removes the last newline
+// of the following text instead of the first. Templates that fail to lex are
+// returned unchanged so that compiling reports the error.
+func trimBlockNewlines(tpl string, cfg *config.Config) string {
+	lexer := tokens.NewLexer(tpl, cfg)
+	go lexer.Run()
+
+	var cuts []int
+	failed := false
+	for tok := range lexer.Tokens {
+		switch tok.Type {
+		case tokens.Error:
+			failed = true
+		case tokens.BlockEnd:
+			if strings.HasPrefix(tok.Val, "+") {
+				continue
+			}
+			end := tok.Pos + len(tok.Val)
+			if strings.HasPrefix(tpl[end:], "\n") || strings.HasPrefix(tpl[end:], "\r\n") {
+				cuts = append(cuts, end)
+			}
+		}
+	}
+	if failed || len(cuts) == 0 {
+		return tpl
+	}
+
+	var b strings.Builder
+	b.Grow(len(tpl))
+	last := 0
+	for _, cut := range cuts {
+		b.WriteString(tpl[last:cut])
+		last = cut + 1
+		if tpl[cut] == '\r' {
+			last++
+		}
+	}
+	b.WriteString(tpl[last:])
+	return b.String()
 }
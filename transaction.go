@@ -0,0 +1,433 @@
+package renderfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// RemoveWriter is implemented by writers that can delete destination paths.
+// Remove deletes a file, a symlink or an empty directory.
+type RemoveWriter interface {
+	Remove(path string) error
+}
+
+// ReadLinkWriter is implemented by writers that can report the target of a
+// symlink at the destination.
+type ReadLinkWriter interface {
+	ReadLink(path string) (string, error)
+}
+
+// Transaction wraps a Writer and journals every change made through it so
+// that Rollback can restore the destination exactly as it was: created files,
+// symlinks and directories are removed, overwritten files and symlinks get
+// their original content, mode or target back, and directories whose mode was
+// changed are reset. Changes are written through to the destination as they
+// happen; the original content of overwritten files is staged in a temporary
+// file of os.TempDir until Commit or Rollback, so it costs disk space rather
+// than memory. Writing through a destination symlink journals the file it
+// points to as well; links leading outside the destination are rejected since
+// that file could not be restored.
+//
+// The wrapped writer must implement LstatWriter and RemoveWriter, and
+// ReadLinkWriter to restore overwritten symlinks.
+type Transaction struct {
+	dest Writer
+
+	mu       sync.Mutex
+	journal  []undoEntry
+	recorded map[string]bool
+	staging  *os.File
+	staged   int64
+	finished bool
+}
+
+type undoKind int
+
+const (
+	undoRemove undoKind = iota
+	undoFile
+	undoSymlink
+	undoDirMode
+)
+
+type undoEntry struct {
+	kind   undoKind
+	path   string
+	mode   fs.FileMode
+	target string
+
+	// offset and size locate the original content of an undoFile entry in
+	// the staging file.
+	offset int64
+	size   int64
+}
+
+// NewTransaction starts a transaction on dest.
+func NewTransaction(dest Writer) (*Transaction, error) {
+	if dest == nil {
+		return nil, fmt.Errorf("renderfs: destination writer is required")
+	}
+	if _, ok := dest.(LstatWriter); !ok {
+		return nil, fmt.Errorf("renderfs: transactional destination must implement LstatWriter")
+	}
+	if _, ok := dest.(RemoveWriter); !ok {
+		return nil, fmt.Errorf("renderfs: transactional destination must implement RemoveWriter")
+	}
+	return &Transaction{dest: dest, recorded: make(map[string]bool)}, nil
+}
+
+// MkdirAll records the directories that do not exist yet and the mode of the
+// final directory, then creates them on the destination.
+func (t *Transaction) MkdirAll(p string, perm fs.FileMode) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.active(); err != nil {
+		return err
+	}
+	p = cleanDestPath(p)
+	if p == "." {
+		return t.dest.MkdirAll(p, perm)
+	}
+	if err := t.recordParents(p); err != nil {
+		return err
+	}
+	if err := t.recordDir(p); err != nil {
+		return err
+	}
+	return t.dest.MkdirAll(p, perm)
+}
+
+// CreateFile records the current state of p, then creates it on the
+// destination.
+func (t *Transaction) CreateFile(p string, perm fs.FileMode) (io.WriteCloser, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.active(); err != nil {
+		return nil, err
+	}
+	p = cleanDestPath(p)
+	if err := t.recordParents(p); err != nil {
+		return nil, err
+	}
+	if err := t.recordEntry(p); err != nil {
+		return nil, err
+	}
+	if err := t.recordLinkTarget(p); err != nil {
+		return nil, err
+	}
+	return t.dest.CreateFile(p, perm)
+}
+
+// Symlink records the current state of newname, then creates the symlink on
+// the destination.
+func (t *Transaction) Symlink(oldname, newname string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.active(); err != nil {
+		return err
+	}
+	newname = cleanDestPath(newname)
+	if err := t.recordParents(newname); err != nil {
+		return err
+	}
+	if err := t.recordEntry(newname); err != nil {
+		return err
+	}
+	return t.dest.Symlink(oldname, newname)
+}
+
+// Remove records the file or symlink at p, then removes it from the
+// destination.
+func (t *Transaction) Remove(p string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.active(); err != nil {
+		return err
+	}
+	p = cleanDestPath(p)
+	if err := t.recordEntry(p); err != nil {
+		return err
+	}
+	return t.dest.(RemoveWriter).Remove(p)
+}
+
+// ReadLink reports the target of a destination symlink when the wrapped
+// writer implements ReadLinkWriter.
+func (t *Transaction) ReadLink(p string) (string, error) {
+	reader, ok := t.dest.(ReadLinkWriter)
+	if !ok {
+		return "", fmt.Errorf("renderfs: destination does not implement ReadLinkWriter")
+	}
+	return reader.ReadLink(p)
+}
+
+// Open reads from the destination, including changes made in the
+// transaction.
+func (t *Transaction) Open(p string) (io.ReadCloser, error) {
+	return t.dest.Open(p)
+}
+
+// Lstat describes a destination path, including changes made in the
+// transaction.
+func (t *Transaction) Lstat(p string) (fs.FileInfo, error) {
+	return t.dest.(LstatWriter).Lstat(p)
+}
+
+// Commit keeps every change and releases the journal.
+func (t *Transaction) Commit() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.active(); err != nil {
+		return err
+	}
+	t.finished = true
+	t.journal = nil
+	return t.closeStaging()
+}
+
+// Rollback undoes every change in reverse order. It attempts every step and
+// returns the joined errors of those that failed.
+func (t *Transaction) Rollback() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.active(); err != nil {
+		return err
+	}
+	t.finished = true
+
+	remover := t.dest.(RemoveWriter)
+	var errs []error
+	for i := len(t.journal) - 1; i >= 0; i-- {
+		entry := t.journal[i]
+		var err error
+		switch entry.kind {
+		case undoRemove:
+			err = remover.Remove(entry.path)
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		case undoFile:
+			err = t.restoreFile(entry)
+		case undoSymlink:
+			err = t.restoreSymlink(entry)
+		case undoDirMode:
+			err = t.dest.MkdirAll(entry.path, entry.mode)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("renderfs: roll back %s: %w", entry.path, err))
+		}
+	}
+	t.journal = nil
+	if err := t.closeStaging(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (t *Transaction) active() error {
+	if t.finished {
+		return fmt.Errorf("renderfs: transaction already finished")
+	}
+	return nil
+}
+
+// recordParents records the state of every ancestor directory of p.
+func (t *Transaction) recordParents(p string) error {
+	dir := path.Dir(p)
+	if dir == "." {
+		return nil
+	}
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		if err := t.recordDir(strings.Join(parts[:i+1], "/")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordDir journals the removal of a missing directory or the mode of an
+// existing one.
+func (t *Transaction) recordDir(dir string) error {
+	if t.recorded[dir] {
+		return nil
+	}
+	info, err := t.dest.(LstatWriter).Lstat(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		t.journal = append(t.journal, undoEntry{kind: undoRemove, path: dir})
+	case err != nil:
+		return fmt.Errorf("renderfs: stat %s: %w", dir, err)
+	case info.IsDir():
+		t.journal = append(t.journal, undoEntry{kind: undoDirMode, path: dir, mode: info.Mode().Perm()})
+	}
+	t.recorded[dir] = true
+	return nil
+}
+
+// recordEntry journals how to restore the file or symlink at p.
+func (t *Transaction) recordEntry(p string) error {
+	if t.recorded[p] {
+		return nil
+	}
+	info, err := t.dest.(LstatWriter).Lstat(p)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		t.journal = append(t.journal, undoEntry{kind: undoRemove, path: p})
+	case err != nil:
+		return fmt.Errorf("renderfs: stat %s: %w", p, err)
+	case info.Mode()&fs.ModeSymlink != 0:
+		reader, ok := t.dest.(ReadLinkWriter)
+		if !ok {
+			return fmt.Errorf("renderfs: cannot record symlink %s: destination does not implement ReadLinkWriter", p)
+		}
+		target, err := reader.ReadLink(p)
+		if err != nil {
+			return fmt.Errorf("renderfs: read symlink %s: %w", p, err)
+		}
+		t.journal = append(t.journal, undoEntry{kind: undoSymlink, path: p, target: target})
+	case info.Mode().IsRegular():
+		offset, size, err := t.stage(p)
+		if err != nil {
+			return err
+		}
+		t.journal = append(t.journal, undoEntry{kind: undoFile, path: p, mode: info.Mode().Perm(), offset: offset, size: size})
+	default:
+		return fmt.Errorf("renderfs: cannot replace %s: not a regular file or symlink", p)
+	}
+	t.recorded[p] = true
+	return nil
+}
+
+// recordLinkTarget journals the files a write to p goes through when p is a
+// symlink: each link of the chain and the file it finally leads to.
+func (t *Transaction) recordLinkTarget(p string) error {
+	for depth := 0; ; depth++ {
+		info, err := t.dest.(LstatWriter).Lstat(p)
+		if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		if depth == maxSymlinkDepth {
+			return fmt.Errorf("renderfs: too many levels of symlinks at %s", p)
+		}
+		reader, ok := t.dest.(ReadLinkWriter)
+		if !ok {
+			return fmt.Errorf("renderfs: cannot write through symlink %s: destination does not implement ReadLinkWriter", p)
+		}
+		target, err := reader.ReadLink(p)
+		if err != nil {
+			return fmt.Errorf("renderfs: read symlink %s: %w", p, err)
+		}
+		target = strings.ReplaceAll(target, "\\", "/")
+		resolved := path.Join(path.Dir(p), target)
+		if strings.HasPrefix(target, "/") || isWindowsAbs(target) || resolved == ".." || strings.HasPrefix(resolved, "../") {
+			return fmt.Errorf("renderfs: cannot write through symlink %s: target %q is outside the destination", p, target)
+		}
+		p = resolved
+		if err := t.recordParents(p); err != nil {
+			return err
+		}
+		if err := t.recordEntry(p); err != nil {
+			return err
+		}
+	}
+}
+
+// stage copies the content of the destination file p to the staging file and
+// returns where it was written.
+func (t *Transaction) stage(p string) (int64, int64, error) {
+	if t.staging == nil {
+		staging, err := os.CreateTemp("", "renderfs-transaction-*")
+		if err != nil {
+			return 0, 0, fmt.Errorf("renderfs: create transaction staging file: %w", err)
+		}
+		t.staging = staging
+	}
+
+	existing, err := t.dest.Open(p)
+	if err != nil {
+		return 0, 0, fmt.Errorf("renderfs: open existing %s: %w", p, err)
+	}
+	defer existing.Close()
+
+	offset := t.staged
+	size, err := io.Copy(io.NewOffsetWriter(t.staging, offset), existing)
+	if err != nil {
+		return 0, 0, fmt.Errorf("renderfs: stage existing %s: %w", p, err)
+	}
+	t.staged += size
+	return offset, size, nil
+}
+
+// closeStaging removes the staging file.
+func (t *Transaction) closeStaging() error {
+	if t.staging == nil {
+		return nil
+	}
+	name := t.staging.Name()
+	err := errors.Join(t.staging.Close(), os.Remove(name))
+	t.staging = nil
+	if err != nil {
+		return fmt.Errorf("renderfs: remove transaction staging file: %w", err)
+	}
+	return nil
+}
+
+func (t *Transaction) restoreFile(entry undoEntry) error {
+	if err := t.removeSymlink(entry.path); err != nil {
+		return err
+	}
+	handle, err := t.dest.CreateFile(entry.path, entry.mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(handle, io.NewSectionReader(t.staging, entry.offset, entry.size)); err != nil {
+		if aborter, ok := handle.(Aborter); ok {
+			_ = aborter.Abort()
+		} else {
+			_ = handle.Close()
+		}
+		return err
+	}
+	return handle.Close()
+}
+
+func (t *Transaction) restoreSymlink(entry undoEntry) error {
+	if err := t.dest.(RemoveWriter).Remove(entry.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return t.dest.Symlink(entry.target, entry.path)
+}
+
+// removeSymlink removes p when a symlink was written over a regular file, so
+// that restoring the file does not write through the link.
+func (t *Transaction) removeSymlink(p string) error {
+	info, err := t.dest.(LstatWriter).Lstat(p)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return nil
+	}
+	return t.dest.(RemoveWriter).Remove(p)
+}
+
+func cleanDestPath(p string) string {
+	return path.Clean(strings.ReplaceAll(p, "\\", "/"))
+}
+
+var (
+	_ Writer         = (*Transaction)(nil)
+	_ LstatWriter    = (*Transaction)(nil)
+	_ RemoveWriter   = (*Transaction)(nil)
+	_ ReadLinkWriter = (*Transaction)(nil)
+)
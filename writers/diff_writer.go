@@ -0,0 +1,182 @@
+package writers
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/greyhoundhq/renderfs"
+)
+
+// DiffWriter implements renderfs.Writer as a dry run against Base. Nothing is
+// written: every file passed to CreateFile is recorded as a unified diff
+// against the content Base currently holds. Directories and symlinks are
+// ignored, and removals only pretend to succeed.
+type DiffWriter struct {
+	// Base is the destination being compared against. A nil Base behaves
+	// like an empty destination.
+	Base renderfs.Writer
+
+	// Context is the number of unchanged lines shown around each change.
+	// Defaults to 3 when zero.
+	Context int
+
+	mu      sync.Mutex
+	diffs   []renderfs.FileDiff
+	removed map[string]bool
+}
+
+// NewDiffWriter constructs a DiffWriter comparing against base.
+func NewDiffWriter(base renderfs.Writer) *DiffWriter {
+	return &DiffWriter{Base: base}
+}
+
+// MkdirAll is a no-op.
+func (w *DiffWriter) MkdirAll(p string, perm fs.FileMode) error {
+	return nil
+}
+
+// CreateFile streams the rendered content into a diff against Base, which is
+// recorded on Close. Only text files are held in memory in full.
+func (w *DiffWriter) CreateFile(p string, perm fs.FileMode) (io.WriteCloser, error) {
+	p = normalizePath(p)
+	kind := renderfs.DiffCreate
+	existing, err := w.Open(p)
+	switch {
+	case err == nil:
+		kind = renderfs.DiffUpdate
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	wc := &diffFileWriteCloser{writer: w, pipe: pw, done: make(chan struct{})}
+	go func() {
+		defer close(wc.done)
+		var old io.Reader
+		if existing != nil {
+			defer existing.Close()
+			old = existing
+		}
+		wc.diff, wc.err = renderfs.DiffReaders(kind, p, old, pr, w.Context)
+		if wc.err != nil {
+			pr.CloseWithError(wc.err)
+			return
+		}
+		// DiffReaders stops after the head of binary content.
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+	return wc, nil
+}
+
+// Symlink is a no-op.
+func (w *DiffWriter) Symlink(oldname, newname string) error {
+	return nil
+}
+
+// Open reads from Base so Copy classifies files against the real destination.
+func (w *DiffWriter) Open(p string) (io.ReadCloser, error) {
+	if w.Base == nil || w.isRemoved(p) {
+		return nil, fs.ErrNotExist
+	}
+	return w.Base.Open(p)
+}
+
+// Lstat reports the entry Base holds at p, so Copy applies OnSymlink to
+// symlinks in the destination. When Base does not implement
+// renderfs.LstatWriter, existing entries are reported as irregular files,
+// which Copy compares by content.
+func (w *DiffWriter) Lstat(p string) (fs.FileInfo, error) {
+	if w.isRemoved(p) {
+		return nil, fs.ErrNotExist
+	}
+	if lw, ok := w.Base.(renderfs.LstatWriter); ok {
+		return lw.Lstat(p)
+	}
+	existing, err := w.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	existing.Close()
+	return memoryFileInfo{name: path.Base(normalizePath(p)), mode: fs.ModeIrregular}, nil
+}
+
+// ReadLink returns the target of a symlink in Base.
+func (w *DiffWriter) ReadLink(p string) (string, error) {
+	rw, ok := w.Base.(renderfs.ReadLinkWriter)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: p, Err: errors.ErrUnsupported}
+	}
+	return rw.ReadLink(p)
+}
+
+// Remove leaves Base untouched but hides p from Open, so a file replacing a
+// destination symlink is diffed as a new file.
+func (w *DiffWriter) Remove(p string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.removed == nil {
+		w.removed = make(map[string]bool)
+	}
+	w.removed[normalizePath(p)] = true
+	return nil
+}
+
+func (w *DiffWriter) isRemoved(p string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.removed[normalizePath(p)]
+}
+
+// Diffs returns the recorded diffs in the order files were written.
+func (w *DiffWriter) Diffs() []renderfs.FileDiff {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]renderfs.FileDiff(nil), w.diffs...)
+}
+
+// String concatenates all recorded diffs into a single patch.
+func (w *DiffWriter) String() string {
+	var b strings.Builder
+	for _, d := range w.Diffs() {
+		b.WriteString(d.Unified)
+	}
+	return b.String()
+}
+
+type diffFileWriteCloser struct {
+	writer *DiffWriter
+	pipe   *io.PipeWriter
+	done   chan struct{}
+	diff   renderfs.FileDiff
+	err    error
+}
+
+func (wc *diffFileWriteCloser) Write(p []byte) (int, error) {
+	return wc.pipe.Write(p)
+}
+
+func (wc *diffFileWriteCloser) Close() error {
+	wc.pipe.Close()
+	<-wc.done
+	if wc.err != nil {
+		return wc.err
+	}
+
+	wc.writer.mu.Lock()
+	defer wc.writer.mu.Unlock()
+	wc.writer.diffs = append(wc.writer.diffs, wc.diff)
+	return nil
+}
+
+var (
+	_ renderfs.Writer         = (*DiffWriter)(nil)
+	_ renderfs.LstatWriter    = (*DiffWriter)(nil)
+	_ renderfs.RemoveWriter   = (*DiffWriter)(nil)
+	_ renderfs.ReadLinkWriter = (*DiffWriter)(nil)
+)
@@ -0,0 +1,97 @@
+package writers
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/greyhoundhq/renderfs"
+)
+
+func TestDiffWriterRecordsChangesWithoutWriting(t *testing.T) {
+	base := NewMemoryWriter()
+	handle, err := base.CreateFile("app.conf", 0o644)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	if _, err := handle.Write([]byte("port = 80\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	handle.Close()
+
+	source := fstest.MapFS{
+		"app.conf": {
+			Data: []byte("port = {{ port }}\n"),
+		},
+		"README.md": {
+			Data: []byte("docs\n"),
+		},
+	}
+
+	writer := NewDiffWriter(base)
+	stats, err := renderfs.Copy(source, writer, renderfs.Options{Context: map[string]any{"port": 8080}})
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if stats.Created != 1 || stats.Updated != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	want := "--- /dev/null\n+++ b/README.md\n@@ -0,0 +1 @@\n+docs\n" +
+		"--- a/app.conf\n+++ b/app.conf\n@@ -1 +1 @@\n-port = 80\n+port = 8080\n"
+	if got := writer.String(); got != want {
+		t.Fatalf("unexpected patch:\n%s", got)
+	}
+
+	if got := string(base.Contents()["app.conf"]); got != "port = 80\n" {
+		t.Fatalf("expected base untouched, got %q", got)
+	}
+	if _, ok := base.Contents()["README.md"]; ok {
+		t.Fatalf("expected README.md not to be written to base")
+	}
+}
+
+func TestDiffWriterHandlesSymlinksAndBinaryFiles(t *testing.T) {
+	base := NewMemoryWriter()
+	handle, err := base.CreateFile("real.conf", 0o644)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	if _, err := handle.Write([]byte("port = 80\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	handle.Close()
+	if err := base.Symlink("real.conf", "app.conf"); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	source := fstest.MapFS{
+		"app.conf":  {Data: []byte("port = 8080\n")},
+		"image.bin": {Data: append([]byte("\x00\x01\x02"), make([]byte, 1<<20)...)},
+	}
+
+	_, err = renderfs.Copy(source, NewDiffWriter(base), renderfs.Options{OnSymlink: renderfs.FailOnSymlinks})
+	var renderErr *renderfs.RenderError
+	if !errors.As(err, &renderErr) || renderErr.Kind != renderfs.RenderErrorSymlink {
+		t.Fatalf("expected the destination symlink to be reported, got %v", err)
+	}
+
+	writer := NewDiffWriter(base)
+	stats, err := renderfs.Copy(source, writer, renderfs.Options{OnSymlink: renderfs.ReplaceSymlinks})
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if stats.Created != 1 || stats.Updated != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// The link is removed rather than written through, so app.conf is new.
+	want := "--- /dev/null\n+++ b/app.conf\n@@ -0,0 +1 @@\n+port = 8080\n" +
+		"Binary files /dev/null and b/image.bin differ\n"
+	if got := writer.String(); got != want {
+		t.Fatalf("unexpected patch:\n%s", got)
+	}
+	if target, err := base.ReadLink("app.conf"); err != nil || target != "real.conf" {
+		t.Fatalf("expected base symlink untouched, got %q, %v", target, err)
+	}
+}
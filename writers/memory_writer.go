@@ -2,9 +2,11 @@ package writers
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"io/fs"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -139,9 +141,75 @@ func (w *MemoryWriter) Lstat(p string) (fs.FileInfo, error) {
 	if link, ok := w.symlinks[p]; ok {
 		return memorySymlinkInfo{name: path.Base(p), target: link.Target}, nil
 	}
+	if w.hasChildren(p) {
+		return memoryDirInfo{name: path.Base(p), mode: 0o755 | fs.ModeDir}, nil
+	}
 	return nil, fs.ErrNotExist
 }
 
+// ReadLink returns the target of an in-memory symlink.
+func (w *MemoryWriter) ReadLink(p string) (string, error) {
+	p = normalizePath(p)
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if link, ok := w.symlinks[p]; ok {
+		return link.Target, nil
+	}
+	return "", &fs.PathError{Op: "readlink", Path: p, Err: fs.ErrNotExist}
+}
+
+// Remove deletes a file, a symlink or an empty directory.
+func (w *MemoryWriter) Remove(p string) error {
+	p = normalizePath(p)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.files[p]; ok {
+		delete(w.files, p)
+		return nil
+	}
+	if _, ok := w.symlinks[p]; ok {
+		delete(w.symlinks, p)
+		return nil
+	}
+	if w.hasChildren(p) {
+		return &fs.PathError{Op: "remove", Path: p, Err: errors.New("directory not empty")}
+	}
+	if _, ok := w.dirs[p]; ok {
+		delete(w.dirs, p)
+		return nil
+	}
+	return &fs.PathError{Op: "remove", Path: p, Err: fs.ErrNotExist}
+}
+
+// hasChildren reports whether any entry is stored below the directory p.
+// Callers must hold w.mu.
+func (w *MemoryWriter) hasChildren(p string) bool {
+	prefix := p + "/"
+	if p == "." {
+		prefix = ""
+	}
+	for k := range w.files {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	for k := range w.symlinks {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	for k := range w.dirs {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // Contents returns a snapshot copy of the stored files for inspection.
 func (w *MemoryWriter) Contents() map[string][]byte {
 	w.mu.RLock()
@@ -154,6 +222,19 @@ func (w *MemoryWriter) Contents() map[string][]byte {
 	return out
 }
 
+// List returns the paths of all stored files in lexical order.
+func (w *MemoryWriter) List() ([]string, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	out := make([]string, 0, len(w.files))
+	for k := range w.files {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
 // FileMode returns the stored mode for the file path.
 func (w *MemoryWriter) FileMode(p string) (fs.FileMode, bool) {
 	w.mu.RLock()
@@ -225,4 +306,9 @@ func (si memorySymlinkInfo) ModTime() time.Time { return time.Unix(0, 0) }
 func (si memorySymlinkInfo) IsDir() bool        { return false }
 func (si memorySymlinkInfo) Sys() interface{}   { return nil }
 
-var _ renderfs.Writer = (*MemoryWriter)(nil)
+var (
+	_ renderfs.Writer         = (*MemoryWriter)(nil)
+	_ renderfs.Lister         = (*MemoryWriter)(nil)
+	_ renderfs.RemoveWriter   = (*MemoryWriter)(nil)
+	_ renderfs.ReadLinkWriter = (*MemoryWriter)(nil)
+)
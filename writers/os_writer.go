@@ -1,17 +1,34 @@
 package writers
 
 import (
+	"errors"
 	"io"
 	"io/fs"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/greyhoundhq/renderfs"
 )
 
+// ErrPathEscapes is returned, wrapped in an *fs.PathError, when a path would
+// resolve outside DestDir, for example through a symlink that already exists
+// in the destination.
+var ErrPathEscapes = errors.New("path escapes the destination directory")
+
 // OSWriter implements renderfs.Writer for the local filesystem rooted at DestDir.
+// Every operation goes through an os.Root, so neither ".." components nor
+// symlinks in the destination can reach files outside DestDir.
 type OSWriter struct {
 	DestDir string
+
+	// Atomic makes CreateFile write to a temporary file in the target's
+	// directory that is fsynced and renamed over the target on Close, so a
+	// crash or write error never leaves a truncated file behind. When the
+	// target is a symlink, the file it points to is replaced instead.
+	Atomic bool
 }
 
 // NewOSWriter constructs an OSWriter rooted at destDir. The destination path
@@ -24,33 +41,114 @@ func NewOSWriter(destDir string) (*OSWriter, error) {
 	return &OSWriter{DestDir: abs}, nil
 }
 
-func (w *OSWriter) join(path string) string {
-	return filepath.Join(w.DestDir, filepath.FromSlash(path))
+// openRoot opens DestDir, creating it first if it does not exist yet.
+func (w *OSWriter) openRoot() (*os.Root, error) {
+	root, err := os.OpenRoot(w.DestDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(w.DestDir, 0o755); err != nil {
+			return nil, err
+		}
+		root, err = os.OpenRoot(w.DestDir)
+	}
+	return root, err
+}
+
+// do runs fn with the root and the OS-specific form of path, translating
+// escape errors into ErrPathEscapes.
+func (w *OSWriter) do(op, path string, fn func(root *os.Root, name string) error) error {
+	if escapesLexically(path) {
+		return &fs.PathError{Op: op, Path: path, Err: ErrPathEscapes}
+	}
+	root, err := w.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	return escapeError(op, path, fn(root, filepath.FromSlash(path)))
+}
+
+// escapesLexically reports whether path leaves DestDir before any symlink is
+// involved, such as "../x" or "/x", so that the common case does not depend
+// on escapeError.
+func escapesLexically(path string) bool {
+	name := filepath.FromSlash(path)
+	if strings.HasPrefix(path, "/") || filepath.IsAbs(name) {
+		return true
+	}
+	clean := filepath.Clean(name)
+	return clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// escapeError replaces the error os.Root reports for paths leaving the root
+// with ErrPathEscapes. Paths are checked with escapesLexically first, so this
+// only covers symlinks in the destination. The os package does not export
+// its sentinel, so the message of its unexported errPathEscapes is matched;
+// it was checked against Go 1.25 through 1.27, and TestEscapeErrorMatchesRoot
+// fails if it changes.
+func escapeError(op, path string, err error) error {
+	for inner := err; inner != nil; inner = errors.Unwrap(inner) {
+		if inner.Error() == "path escapes from parent" {
+			return &fs.PathError{Op: op, Path: path, Err: ErrPathEscapes}
+		}
+	}
+	return err
 }
 
 // MkdirAll creates directories on disk and ensures the final directory has the
 // requested permissions.
 func (w *OSWriter) MkdirAll(path string, perm fs.FileMode) error {
-	full := w.join(path)
-	if err := os.MkdirAll(full, perm); err != nil {
-		return err
-	}
-	return os.Chmod(full, perm.Perm())
+	return w.do("mkdir", path, func(root *os.Root, name string) error {
+		if err := root.MkdirAll(name, perm); err != nil {
+			return err
+		}
+		return root.Chmod(name, perm.Perm())
+	})
 }
 
 // CreateFile opens a file for writing, creating any missing parent directories.
 func (w *OSWriter) CreateFile(path string, perm fs.FileMode) (io.WriteCloser, error) {
-	full := w.join(path)
-	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+	if escapesLexically(path) {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: ErrPathEscapes}
+	}
+	root, err := w.openRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := w.createFile(root, filepath.FromSlash(path), perm)
+	if err != nil {
+		_ = root.Close()
+		return nil, escapeError("open", path, err)
+	}
+	if !w.Atomic {
+		_ = root.Close()
+	}
+	return handle, nil
+}
+
+func (w *OSWriter) createFile(root *os.Root, name string, perm fs.FileMode) (io.WriteCloser, error) {
+	if err := root.MkdirAll(filepath.Dir(name), 0o755); err != nil {
 		return nil, err
 	}
 
-	f, err := os.OpenFile(full, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if w.Atomic {
+		// Renaming over a symlink would replace the link, so the temporary
+		// file goes next to the file the link points to, which is then
+		// written through like a plain open would.
+		target, err := resolveLinks(root, name)
+		if err != nil {
+			return nil, err
+		}
+		return createAtomic(root, target, perm)
+	}
+
+	f, err := root.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := os.Chmod(full, perm.Perm()); err != nil {
+	if err := f.Chmod(perm.Perm()); err != nil {
 		_ = f.Close()
 		return nil, err
 	}
@@ -58,24 +156,186 @@ func (w *OSWriter) CreateFile(path string, perm fs.FileMode) (io.WriteCloser, er
 	return f, nil
 }
 
+// maxLinks is the number of symlinks resolveLinks follows before giving up.
+const maxLinks = 40
+
+// resolveLinks follows name while it is a symlink and returns the path,
+// relative to root, of what it finally points to. Links leaving root fail
+// with ErrPathEscapes.
+func resolveLinks(root *os.Root, name string) (string, error) {
+	for range maxLinks {
+		info, err := root.Lstat(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			return name, nil
+		}
+		target, err := root.Readlink(name)
+		if err != nil {
+			return "", err
+		}
+		next := filepath.Join(filepath.Dir(name), target)
+		if filepath.IsAbs(target) || strings.HasPrefix(filepath.ToSlash(target), "/") || escapesLexically(filepath.ToSlash(next)) {
+			return "", &fs.PathError{Op: "open", Path: filepath.ToSlash(name), Err: ErrPathEscapes}
+		}
+		name = next
+	}
+	return "", &fs.PathError{Op: "open", Path: filepath.ToSlash(name), Err: errors.New("too many levels of symlinks")}
+}
+
+// atomicFile writes to a temporary file that replaces target on Close. It
+// owns root and closes it once the file is committed or discarded.
+type atomicFile struct {
+	root     *os.Root
+	file     *os.File
+	temp     string
+	target   string
+	writeErr error
+}
+
+func createAtomic(root *os.Root, target string, perm fs.FileMode) (*atomicFile, error) {
+	prefix := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".tmp-")
+	for {
+		temp := prefix + strconv.FormatUint(rand.Uint64(), 36)
+		f, err := root.OpenFile(temp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := f.Chmod(perm.Perm()); err != nil {
+			_ = f.Close()
+			_ = root.Remove(temp)
+			return nil, err
+		}
+		return &atomicFile{root: root, file: f, temp: temp, target: target}, nil
+	}
+}
+
+func (f *atomicFile) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	if err != nil && f.writeErr == nil {
+		f.writeErr = err
+	}
+	return n, err
+}
+
+// Close fsyncs the temporary file and renames it over the target. If any
+// write failed, the temporary file is removed instead.
+func (f *atomicFile) Close() error {
+	if f.writeErr != nil {
+		_ = f.Abort()
+		return f.writeErr
+	}
+	if err := f.file.Sync(); err != nil {
+		_ = f.Abort()
+		return err
+	}
+	defer f.root.Close()
+	if err := f.file.Close(); err != nil {
+		_ = f.root.Remove(f.temp)
+		return err
+	}
+	if err := f.root.Rename(f.temp, f.target); err != nil {
+		_ = f.root.Remove(f.temp)
+		return escapeError("rename", filepath.ToSlash(f.target), err)
+	}
+	return nil
+}
+
+// Abort discards the temporary file and leaves the target untouched.
+func (f *atomicFile) Abort() error {
+	defer f.root.Close()
+	_ = f.file.Close()
+	return f.root.Remove(f.temp)
+}
+
 // Open opens the named file for reading.
 func (w *OSWriter) Open(path string) (io.ReadCloser, error) {
-	return os.Open(w.join(path))
+	var f *os.File
+	err := w.do("open", path, func(root *os.Root, name string) error {
+		var err error
+		f, err = root.Open(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
-// Symlink creates a symbolic link within DestDir.
+// Symlink creates a symbolic link within DestDir. The target is stored as
+// given; links pointing outside DestDir are never followed by the writer.
 func (w *OSWriter) Symlink(oldname, newname string) error {
-	full := w.join(newname)
-	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
-		return err
-	}
-	return os.Symlink(oldname, full)
+	return w.do("symlink", newname, func(root *os.Root, name string) error {
+		if err := root.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return err
+		}
+		return root.Symlink(oldname, name)
+	})
 }
 
 // Lstat reports information about a path relative to DestDir. It allows Copy to
 // implement conflict handling semantics.
 func (w *OSWriter) Lstat(path string) (fs.FileInfo, error) {
-	return os.Lstat(w.join(path))
+	var info fs.FileInfo
+	err := w.do("lstat", path, func(root *os.Root, name string) error {
+		var err error
+		info, err = root.Lstat(name)
+		return err
+	})
+	return info, err
+}
+
+// ReadLink returns the target of a symlink relative to DestDir.
+func (w *OSWriter) ReadLink(path string) (string, error) {
+	var target string
+	err := w.do("readlink", path, func(root *os.Root, name string) error {
+		var err error
+		target, err = root.Readlink(name)
+		return err
+	})
+	return target, err
 }
 
-var _ renderfs.Writer = (*OSWriter)(nil)
+// Remove deletes a file, a symlink or an empty directory within DestDir.
+func (w *OSWriter) Remove(path string) error {
+	return w.do("remove", path, func(root *os.Root, name string) error {
+		return root.Remove(name)
+	})
+}
+
+// List walks DestDir and returns the slash-separated paths of all regular
+// files and symlinks in lexical order.
+func (w *OSWriter) List() ([]string, error) {
+	var out []string
+	err := w.do("list", ".", func(root *os.Root, _ string) error {
+		return fs.WalkDir(root.FS(), ".", func(rel string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			out = append(out, rel)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var (
+	_ renderfs.Writer         = (*OSWriter)(nil)
+	_ renderfs.Lister         = (*OSWriter)(nil)
+	_ renderfs.RemoveWriter   = (*OSWriter)(nil)
+	_ renderfs.ReadLinkWriter = (*OSWriter)(nil)
+	_ renderfs.Aborter        = (*atomicFile)(nil)
+)
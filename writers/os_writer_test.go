@@ -1,9 +1,12 @@
 package writers
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/greyhoundhq/renderfs"
 )
 
 func TestOSWriterCreatesDirectoriesAndFiles(t *testing.T) {
@@ -72,3 +75,193 @@ func TestOSWriterSymlink(t *testing.T) {
 		t.Fatalf("unexpected link target: %q", target)
 	}
 }
+
+func TestOSWriterAtomicCreateFile(t *testing.T) {
+	dest := t.TempDir()
+	writer, err := NewOSWriter(dest)
+	if err != nil {
+		t.Fatalf("NewOSWriter: %v", err)
+	}
+	writer.Atomic = true
+
+	target := filepath.Join(dest, "config.yaml")
+	if err := os.WriteFile(target, []byte("original"), 0o644); err != nil {
+		t.Fatalf("prepare target: %v", err)
+	}
+
+	handle, err := writer.CreateFile("config.yaml", 0o600)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	if _, err := handle.Write([]byte("partial")); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if content, _ := os.ReadFile(target); string(content) != "original" {
+		t.Fatalf("target changed before Close: %q", content)
+	}
+	if err := handle.(renderfs.Aborter).Abort(); err != nil {
+		t.Fatalf("Abort: %v", err)
+	}
+	if content, _ := os.ReadFile(target); string(content) != "original" {
+		t.Fatalf("target changed after Abort: %q", content)
+	}
+
+	handle, err = writer.CreateFile("config.yaml", 0o600)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	if _, err := handle.Write([]byte("replaced")); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := handle.Close(); err != nil {
+		t.Fatalf("close file: %v", err)
+	}
+
+	content, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if string(content) != "replaced" {
+		t.Fatalf("unexpected file content: %q", string(content))
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatalf("stat file: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected file perm 600, got %o", info.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected temporary files to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestOSWriterTransactionRollback(t *testing.T) {
+	dest := t.TempDir()
+	writer, err := NewOSWriter(dest)
+	if err != nil {
+		t.Fatalf("NewOSWriter: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "config.yaml"), []byte("original"), 0o644); err != nil {
+		t.Fatalf("prepare destination: %v", err)
+	}
+
+	tx, err := renderfs.NewTransaction(writer)
+	if err != nil {
+		t.Fatalf("NewTransaction: %v", err)
+	}
+	for _, p := range []string{"config.yaml", "nested/dir/new.txt"} {
+		handle, err := tx.CreateFile(p, 0o600)
+		if err != nil {
+			t.Fatalf("CreateFile %s: %v", p, err)
+		}
+		if _, err := handle.Write([]byte("changed")); err != nil {
+			t.Fatalf("write %s: %v", p, err)
+		}
+		if err := handle.Close(); err != nil {
+			t.Fatalf("close %s: %v", p, err)
+		}
+	}
+	if err := tx.Symlink("config.yaml", "alias.yaml"); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dest, "config.yaml"))
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if string(content) != "original" {
+		t.Fatalf("expected original content, got %q", content)
+	}
+	info, err := os.Stat(filepath.Join(dest, "config.yaml"))
+	if err != nil {
+		t.Fatalf("stat file: %v", err)
+	}
+	if info.Mode().Perm() != 0o644 {
+		t.Fatalf("expected file perm 644, got %o", info.Mode().Perm())
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected created files and directories to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestOSWriterRejectsSymlinkEscapes(t *testing.T) {
+	outside := t.TempDir()
+	dest := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dest, "config")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+
+	writer, err := NewOSWriter(dest)
+	if err != nil {
+		t.Fatalf("NewOSWriter: %v", err)
+	}
+
+	if _, err := writer.CreateFile("config/app.yaml", 0o644); !errors.Is(err, ErrPathEscapes) {
+		t.Fatalf("expected CreateFile to report ErrPathEscapes, got %v", err)
+	}
+	if err := writer.MkdirAll("config/nested", 0o755); !errors.Is(err, ErrPathEscapes) {
+		t.Fatalf("expected MkdirAll to report ErrPathEscapes, got %v", err)
+	}
+	if _, err := writer.Open("../outside.txt"); !errors.Is(err, ErrPathEscapes) {
+		t.Fatalf("expected Open to report ErrPathEscapes, got %v", err)
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatalf("read outside dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected nothing written outside the destination, found %d entries", len(entries))
+	}
+}
+
+// TestEscapeErrorMatchesRoot pins the os.Root error message escapeError
+// matches, since the os package does not export the error. If it fails after
+// a Go upgrade, update the message in escapeError; escapesLexically keeps
+// handling ".." and absolute paths either way.
+func TestEscapeErrorMatchesRoot(t *testing.T) {
+	outside := t.TempDir()
+	dest := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dest, "link")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+	root, err := os.OpenRoot(dest)
+	if err != nil {
+		t.Fatalf("OpenRoot: %v", err)
+	}
+	defer root.Close()
+
+	// Only a symlink in the destination reaches the message match.
+	_, err = root.Create(filepath.Join("link", "file.txt"))
+	if err == nil {
+		t.Fatalf("expected os.Root to reject the escaping symlink")
+	}
+	if !errors.Is(escapeError("open", "link/file.txt", err), ErrPathEscapes) {
+		t.Fatalf("escapeError no longer recognizes the os.Root escape error %q; update its message match", err)
+	}
+
+	for _, path := range []string{"../x", "a/../../x", "/etc/x"} {
+		if !escapesLexically(path) {
+			t.Fatalf("expected %q to escape lexically", path)
+		}
+	}
+	for _, path := range []string{"x", "a/../x", "..x/y"} {
+		if escapesLexically(path) {
+			t.Fatalf("expected %q to stay within the root", path)
+		}
+	}
+}